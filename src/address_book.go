@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const peersFile = "peers_%s.dat"
+const peersFileVersion = 1
+
+// Connecting again to an address waits reconnectDelay after the last attempt, doubled for
+// every failure in a row up to maxReconnectDelay
+const reconnectDelay = time.Second
+const maxReconnectDelay = 10 * time.Minute
+
+// The new bucket holds the addresses heard from peers, the tried bucket the ones this node
+// connected to. Both are bounded so peers advertising many addresses cannot fill the memory
+// or push out the nodes known to work.
+const maxNewAddresses = 1024
+const maxTriedAddresses = 256
+
+// Addresses that failed maxSampleFailures times in a row are not passed on to other peers
+const maxSampleFailures = 3
+
+type knownAddress struct {
+	Addr        string
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Successes   int
+	// Failures counts the failed attempts and the connections that dropped soon after the
+	// handshake since the last connection that lasted
+	Failures int
+}
+
+func (ka *knownAddress) retryDelay() time.Duration {
+	delay := reconnectDelay
+	for i := 0; i < ka.Failures && delay < maxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+
+	return delay
+}
+
+// AddressBook remembers the addresses of other nodes and how connecting to them went, so
+// dropped peers are dialed again, less and less often while they do not answer. An address
+// is in the new bucket until a connection to it completes the handshake, then in the tried
+// bucket.
+type AddressBook struct {
+	mutex sync.Mutex
+	addrs map[string]*knownAddress
+	tried map[string]*knownAddress
+}
+
+func NewAddressBook() *AddressBook {
+	return &AddressBook{
+		addrs: make(map[string]*knownAddress),
+		tried: make(map[string]*knownAddress),
+	}
+}
+
+// Add adds a new address and reports whether it was added. Malformed and known addresses
+// are not.
+func (ab *AddressBook) Add(addr string) bool {
+	if !validAddress(addr) {
+		return false
+	}
+
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	if ab.lookup(addr) != nil {
+		return false
+	}
+	ab.addNew(&knownAddress{Addr: addr})
+
+	return true
+}
+
+func (ab *AddressBook) Remove(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	delete(ab.addrs, addr)
+	delete(ab.tried, addr)
+}
+
+func (ab *AddressBook) Count() int {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	return len(ab.addrs) + len(ab.tried)
+}
+
+// TriedCount returns the number of addresses this node connected to
+func (ab *AddressBook) TriedCount() int {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	return len(ab.tried)
+}
+
+// Sample returns up to n addresses picked at random from both buckets, leaving out the
+// ones that keep failing, to advertise to peers
+func (ab *AddressBook) Sample(n int) []string {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	var addrs []string
+	for _, ka := range ab.all() {
+		if ka.Failures < maxSampleFailures {
+			addrs = append(addrs, ka.Addr)
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	return addrs
+}
+
+// Due returns the addresses that may be dialed at the given time, the ones that connected
+// last first
+func (ab *AddressBook) Due(now time.Time) []string {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	var due []*knownAddress
+	for _, ka := range ab.all() {
+		if !now.Before(ka.LastAttempt.Add(ka.retryDelay())) {
+			due = append(due, ka)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].LastSuccess.Equal(due[j].LastSuccess) {
+			return due[i].LastSuccess.After(due[j].LastSuccess)
+		}
+		return due[i].Addr < due[j].Addr
+	})
+
+	var addrs []string
+	for _, ka := range due {
+		addrs = append(addrs, ka.Addr)
+	}
+
+	return addrs
+}
+
+// Attempt records that the address is being dialed
+func (ab *AddressBook) Attempt(addr string) {
+	ab.update(addr, func(ka *knownAddress) {
+		ka.LastAttempt = time.Now()
+	})
+}
+
+// Connected records a connection that completed the handshake and moves the address to
+// the tried bucket. The failures are only forgotten once the connection lasted, see Stable.
+func (ab *AddressBook) Connected(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	ka := ab.lookup(addr)
+	if ka == nil {
+		return
+	}
+	ka.LastSuccess = time.Now()
+	ka.Successes++
+
+	if _, ok := ab.addrs[addr]; ok {
+		delete(ab.addrs, addr)
+		ab.addTried(ka)
+	}
+}
+
+// Failed records a connection that could not be opened or dropped too early
+func (ab *AddressBook) Failed(addr string) {
+	ab.update(addr, func(ka *knownAddress) {
+		ka.Failures++
+	})
+}
+
+// Stable records a connection that lasted, which resets the backoff
+func (ab *AddressBook) Stable(addr string) {
+	ab.update(addr, func(ka *knownAddress) {
+		ka.Failures = 0
+	})
+}
+
+// RetryDelay returns how long after the last attempt the address is dialed again
+func (ab *AddressBook) RetryDelay(addr string) time.Duration {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	if ka := ab.lookup(addr); ka != nil {
+		return ka.retryDelay()
+	}
+
+	return reconnectDelay
+}
+
+func (ab *AddressBook) update(addr string, change func(ka *knownAddress)) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	if ka := ab.lookup(addr); ka != nil {
+		change(ka)
+	}
+}
+
+// lookup returns the entry of an address in either bucket, the mutex must be held
+func (ab *AddressBook) lookup(addr string) *knownAddress {
+	if ka, ok := ab.tried[addr]; ok {
+		return ka
+	}
+
+	return ab.addrs[addr]
+}
+
+// all returns the entries of both buckets, the mutex must be held
+func (ab *AddressBook) all() []*knownAddress {
+	known := make([]*knownAddress, 0, len(ab.addrs)+len(ab.tried))
+	for _, ka := range ab.tried {
+		known = append(known, ka)
+	}
+	for _, ka := range ab.addrs {
+		known = append(known, ka)
+	}
+
+	return known
+}
+
+// addNew puts an entry in the new bucket, evicting the address that failed the most when
+// the bucket is full, the mutex must be held
+func (ab *AddressBook) addNew(ka *knownAddress) {
+	if len(ab.addrs) >= maxNewAddresses {
+		var worst *knownAddress
+		for _, candidate := range ab.addrs {
+			if worst == nil || candidate.Failures > worst.Failures {
+				worst = candidate
+			}
+		}
+		delete(ab.addrs, worst.Addr)
+	}
+	ab.addrs[ka.Addr] = ka
+}
+
+// addTried puts an entry in the tried bucket. When it is full the address connected the
+// longest ago goes back to the new bucket. The mutex must be held.
+func (ab *AddressBook) addTried(ka *knownAddress) {
+	if len(ab.tried) >= maxTriedAddresses {
+		var oldest *knownAddress
+		for _, candidate := range ab.tried {
+			if oldest == nil || candidate.LastSuccess.Before(oldest.LastSuccess) {
+				oldest = candidate
+			}
+		}
+		delete(ab.tried, oldest.Addr)
+		ab.addNew(oldest)
+	}
+	ab.tried[ka.Addr] = ka
+}
+
+// Save writes the addresses and their connection history to a file
+func (ab *AddressBook) Save(path string) error {
+	ab.mutex.Lock()
+	known := ab.all()
+	ab.mutex.Unlock()
+	sort.Slice(known, func(i, j int) bool { return known[i].Addr < known[j].Addr })
+
+	w := newBinaryWriter(peersFileVersion)
+	w.writeUvarint(uint64(len(known)))
+	for _, ka := range known {
+		w.writeBytes([]byte(ka.Addr))
+		w.writeVarint(unixTime(ka.LastAttempt))
+		w.writeVarint(unixTime(ka.LastSuccess))
+		w.writeUvarint(uint64(ka.Successes))
+		w.writeUvarint(uint64(ka.Failures))
+	}
+
+	// a crash while writing must not leave a truncated file behind
+	tmpPath := path + ".new"
+	if err := ioutil.WriteFile(tmpPath, w.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Load adds the addresses saved by Save and returns how many there were
+func (ab *AddressBook) Load(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	r, version := newBinaryReader(data)
+	if r.err == nil && version != peersFileVersion {
+		return 0, fmt.Errorf("unsupported peers file version %d", version)
+	}
+
+	var known []*knownAddress
+	for i, n := 0, r.readCount(5); i < n; i++ {
+		ka := &knownAddress{Addr: string(r.readBytes())}
+		ka.LastAttempt = fromUnixTime(r.readVarint())
+		ka.LastSuccess = fromUnixTime(r.readVarint())
+		ka.Successes = int(r.readUvarint())
+		ka.Failures = int(r.readUvarint())
+		known = append(known, ka)
+	}
+	if err := r.finish(); err != nil {
+		return 0, err
+	}
+
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	// the bucket of an address follows from its history
+	loaded := 0
+	for _, ka := range known {
+		if !validAddress(ka.Addr) || ab.lookup(ka.Addr) != nil {
+			continue
+		}
+		if ka.Successes > 0 {
+			ab.addTried(ka)
+		} else {
+			ab.addNew(ka)
+		}
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// validAddress reports whether addr is a host and a port a node could listen on
+func validAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+
+	return err == nil && n > 0 && n < 65536
+}
+
+// unixTime stores the zero time, an address never attempted or never connected, as 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+func fromUnixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(seconds, 0)
+}
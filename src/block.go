@@ -1,72 +1,176 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
 	"time"
 )
 
+const blockVersion = headerHashVersion
+
 type Block struct {
+	BlockHeader
 	Transactions []*Transaction
-	Timestamp    string
 	Hash         string
-	PreviousHash string
-	Nonce        int
 	Height       int
 }
 
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
+// NewBlock creates a block and mines it
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32) *Block {
+	block := newUnminedBlock(transactions, prevBlockHash, height, bits)
+
+	err := NewMiner(miningThreads).Mine(context.Background(), block)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return block
+}
+
+// newUnminedBlock creates a block without proof of work
+func newUnminedBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32) *Block {
 	block := &Block{
-		transactions,
-		strconv.FormatInt(time.Now().Unix(), 10),
-		string(prevBlockHash),
-		"",
-		0,
-		height}
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = string(hash[:])
-	block.Nonce = nonce
+		BlockHeader: BlockHeader{
+			Version:      blockVersion,
+			PreviousHash: string(prevBlockHash),
+			Timestamp:    time.Now().Unix(),
+			Bits:         bits,
+		},
+		Transactions: transactions,
+		Height:       height,
+	}
+	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, targetBitsToCompact(chainParams.InitialTargetBits))
 }
 
+// Serialize returns the canonical encoding of the block: the serialized header followed by
+// the height and the transactions, each written with its own version. Blocks hashed before
+// the header was introduced keep their own layout.
 func (b *Block) Serialize() []byte {
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
+	w := newBinaryWriter(b.Version)
 
-	err := encoder.Encode(b)
-	if err != nil {
-		fmt.Printf("Serialization error: %s", err)
+	if b.Version < headerHashVersion {
+		b.writeStringHashed(w)
+	} else {
+		b.BlockHeader.write(w)
+		w.writeVarint(int64(b.Height))
 	}
 
-	return result.Bytes()
+	w.writeUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		w.writeUvarint(uint64(tx.version))
+		tx.write(w)
+	}
+
+	return w.Bytes()
+}
+
+func (b *Block) writeStringHashed(w *binaryWriter) {
+	w.writeBytes([]byte(strconv.FormatInt(b.Timestamp, 10)))
+	w.writeHash(b.Hash)
+	w.writeHash(b.PreviousHash)
+	w.writeVarint(int64(b.Nonce))
+	w.writeVarint(int64(b.Height))
+	w.writeUint32(b.Bits)
 }
 
+// DeserializeBlock decodes a block in the canonical encoding, or a version 0 block encoded with gob
 func DeserializeBlock(d []byte) *Block {
-	var block Block
+	var block *Block
+	var err error
 
-	decoder := gob.NewDecoder(bytes.NewReader(d))
-	err := decoder.Decode(&block)
+	if isCanonical(d) {
+		block, err = readBlock(d)
+	} else {
+		block, err = decodeLegacyBlock(d)
+	}
 	if err != nil {
 		fmt.Printf("Deserialization error: %s", err)
+		return &Block{}
+	}
+
+	return block
+}
+
+// DeserializeRelayedBlock decodes a block received from a peer or submitted over RPC. Older
+// layouts are only read from the database, see checkRelayedVersion.
+func DeserializeRelayedBlock(d []byte) (*Block, error) {
+	r, version := newBinaryReader(d)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := checkRelayedVersion(version); err != nil {
+		return nil, err
+	}
+
+	return readBlock(d)
+}
+
+func readBlock(d []byte) (*Block, error) {
+	r, version := newBinaryReader(d)
+	block := &Block{}
+
+	if version < headerHashVersion {
+		block.readStringHashed(r, version)
+	} else {
+		block.BlockHeader = readBlockHeader(r, version)
+		block.Height = r.readInt()
+	}
+
+	for i, n := 0, r.readCount(3); i < n; i++ {
+		txVersion := int(r.readUvarint())
+		block.Transactions = append(block.Transactions, readTransaction(r, txVersion))
 	}
 
-	return &block
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+
+	if version < headerHashVersion {
+		block.MerkleRoot = block.HashTransactions()
+	} else {
+		block.Hash = string(block.BlockHeader.Hash())
+	}
+
+	return block, nil
+}
+
+func (b *Block) readStringHashed(r *binaryReader, version int) {
+	b.Version = version
+
+	timestamp := string(r.readBytes())
+	b.Hash = r.readHash()
+	b.PreviousHash = r.readHash()
+	b.Nonce = r.readInt()
+	b.Height = r.readInt()
+	b.Bits = r.readUint32()
+
+	parsed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || strconv.FormatInt(parsed, 10) != timestamp {
+		r.fail(errors.New("invalid timestamp"))
+	}
+	b.Timestamp = parsed
 }
 
+// HashTransactions returns the Merkle root of the transactions. Version 0 blocks commit
+// to the gob encoding of their transactions, IDs included.
 func (b *Block) HashTransactions() string {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		if b.Version == legacyVersion {
+			transactions = append(transactions, tx.legacySerialize())
+		} else {
+			transactions = append(transactions, tx.Serialize())
+		}
 	}
 
 	mTree := NewMerkleTree(transactions)
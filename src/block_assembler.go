@@ -0,0 +1,278 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// blockReservedWeight leaves room for the header and the coinbase, which are added after the
+// transactions are picked
+const blockReservedWeight = 4 * 1000
+
+// SelectionOrder decides which mempool transactions go into a block first
+type SelectionOrder int
+
+const (
+	// SelectByFeeRate ranks transactions by the fee rate of the package made of the
+	// transaction and its unconfirmed ancestors, so a child can pay for its parent
+	SelectByFeeRate SelectionOrder = iota
+	// SelectByArrival takes transactions in the order they entered the mempool
+	SelectByArrival
+)
+
+func (o SelectionOrder) String() string {
+	switch o {
+	case SelectByFeeRate:
+		return "feerate"
+	case SelectByArrival:
+		return "arrival"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseSelectionOrder parses the name printed by String
+func ParseSelectionOrder(name string) (SelectionOrder, error) {
+	for _, order := range []SelectionOrder{SelectByFeeRate, SelectByArrival} {
+		if order.String() == name {
+			return order, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown selection order %q", name)
+}
+
+// BlockPolicy limits what the block assembler puts in a block, within the consensus limits
+type BlockPolicy struct {
+	// MaxWeight bounds the weight of the block, header and coinbase included
+	MaxWeight int
+	MaxSigOps int
+	// MaxTxs caps the transactions besides the coinbase, zero means no limit
+	MaxTxs int
+	Order  SelectionOrder
+}
+
+func DefaultBlockPolicy() BlockPolicy {
+	return BlockPolicy{MaxWeight: maxBlockWeight, MaxSigOps: maxBlockSigOps}
+}
+
+// BlockAssembler picks the mempool transactions of a block. For the same mempool it always
+// returns the same transactions in the same order.
+type BlockAssembler struct {
+	Policy BlockPolicy
+
+	txs    []*Transaction
+	fees   int
+	weight int
+	sigOps int
+}
+
+func NewBlockAssembler(policy BlockPolicy) *BlockAssembler {
+	return &BlockAssembler{Policy: policy}
+}
+
+// Assemble returns the transactions for a block, parents before children, and the fees
+// they pay
+func (a *BlockAssembler) Assemble(mp *Mempool) ([]*Transaction, int) {
+	a.txs, a.fees, a.weight, a.sigOps = nil, 0, blockReservedWeight, 0
+	entries := mp.snapshot()
+
+	if a.Policy.Order == SelectByArrival {
+		a.addByArrival(entries)
+	} else {
+		a.addPackages(entries)
+	}
+
+	return a.txs, a.fees
+}
+
+// fits reports whether transactions of the given total weight and signature checks still
+// fit, under both the policy and the consensus limits
+func (a *BlockAssembler) fits(count, weight, sigOps int) bool {
+	if a.Policy.MaxTxs > 0 && len(a.txs)+count > a.Policy.MaxTxs {
+		return false
+	}
+
+	weight, sigOps = a.weight+weight, a.sigOps+sigOps
+
+	return weight <= a.Policy.MaxWeight && weight <= maxBlockWeight &&
+		sigOps <= a.Policy.MaxSigOps && sigOps <= maxBlockSigOps
+}
+
+func (a *BlockAssembler) add(entry mempoolEntry) {
+	a.txs = append(a.txs, entry.Tx)
+	a.fees += entry.Fee
+	a.weight += entry.Weight
+	a.sigOps += transactionSigOps(entry.Tx)
+}
+
+func (a *BlockAssembler) addByArrival(entries []mempoolEntry) {
+	included := make(map[string]bool)
+	pooled := make(map[string]bool)
+	for _, entry := range entries {
+		pooled[entry.Tx.ID] = true
+	}
+
+	for _, entry := range entries {
+		parentsIncluded := true
+		for _, vin := range entry.Tx.Vin {
+			if pooled[vin.TxID] && !included[vin.TxID] {
+				parentsIncluded = false
+			}
+		}
+
+		if parentsIncluded && a.fits(1, entry.Weight, transactionSigOps(entry.Tx)) {
+			included[entry.Tx.ID] = true
+			a.add(entry)
+		}
+	}
+}
+
+// packageCandidate tracks a transaction and the package of its ancestors that are not in
+// the block yet
+type packageCandidate struct {
+	entry     mempoolEntry
+	ancestors map[string]bool
+	children  []string
+
+	fee, size, weight, sigOps int
+	included                  bool
+}
+
+// addPackages repeatedly adds the package with the highest fee rate that still fits. Adding
+// a package lowers the packages of its descendants, which are ranked again.
+func (a *BlockAssembler) addPackages(entries []mempoolEntry) {
+	candidates := make(map[string]*packageCandidate)
+	for _, entry := range entries {
+		candidates[entry.Tx.ID] = &packageCandidate{entry: entry}
+	}
+
+	// entries come parents first, so the ancestors of the parents are already known
+	for _, entry := range entries {
+		c := candidates[entry.Tx.ID]
+		c.ancestors = make(map[string]bool)
+
+		for _, vin := range entry.Tx.Vin {
+			parent, ok := candidates[vin.TxID]
+			if !ok || c.ancestors[vin.TxID] {
+				continue
+			}
+
+			parent.children = append(parent.children, entry.Tx.ID)
+			c.ancestors[vin.TxID] = true
+			for ancestor := range parent.ancestors {
+				c.ancestors[ancestor] = true
+			}
+		}
+
+		c.fee, c.size, c.weight, c.sigOps = c.entry.Fee, c.entry.Size, c.entry.Weight, transactionSigOps(c.entry.Tx)
+		for ancestor := range c.ancestors {
+			c.fee += candidates[ancestor].entry.Fee
+			c.size += candidates[ancestor].entry.Size
+			c.weight += candidates[ancestor].entry.Weight
+			c.sigOps += transactionSigOps(candidates[ancestor].entry.Tx)
+		}
+	}
+
+	queue := &packageQueue{}
+	for id, c := range candidates {
+		heap.Push(queue, packageRank{id, c.fee, c.size})
+	}
+
+	for queue.Len() > 0 {
+		rank := heap.Pop(queue).(packageRank)
+		c := candidates[rank.id]
+		// ranks are pushed again when a package changes, older ones are stale
+		if c.included || rank.fee != c.fee || rank.size != c.size {
+			continue
+		}
+
+		var pkg []*packageCandidate
+		for ancestor := range c.ancestors {
+			if !candidates[ancestor].included {
+				pkg = append(pkg, candidates[ancestor])
+			}
+		}
+		pkg = append(pkg, c)
+
+		if !a.fits(len(pkg), c.weight, c.sigOps) {
+			continue
+		}
+
+		// a transaction has more ancestors than any of its own ancestors
+		sort.Slice(pkg, func(i, j int) bool {
+			if len(pkg[i].ancestors) != len(pkg[j].ancestors) {
+				return len(pkg[i].ancestors) < len(pkg[j].ancestors)
+			}
+			return pkg[i].entry.Tx.ID < pkg[j].entry.Tx.ID
+		})
+
+		for _, member := range pkg {
+			member.included = true
+			a.add(member.entry)
+		}
+		for _, member := range pkg {
+			for id := range descendants(candidates, member.entry.Tx.ID) {
+				d := candidates[id]
+				if d.included {
+					continue
+				}
+
+				d.fee -= member.entry.Fee
+				d.size -= member.entry.Size
+				d.weight -= member.entry.Weight
+				d.sigOps -= transactionSigOps(member.entry.Tx)
+				heap.Push(queue, packageRank{id, d.fee, d.size})
+			}
+		}
+	}
+}
+
+func descendants(candidates map[string]*packageCandidate, id string) map[string]bool {
+	found := make(map[string]bool)
+
+	var collect func(id string)
+	collect = func(id string) {
+		for _, child := range candidates[id].children {
+			if !found[child] {
+				found[child] = true
+				collect(child)
+			}
+		}
+	}
+	collect(id)
+
+	return found
+}
+
+type packageRank struct {
+	id        string
+	fee, size int
+}
+
+// packageQueue is a max-heap of package fee rates, ties broken by transaction ID
+type packageQueue []packageRank
+
+func (q packageQueue) Len() int { return len(q) }
+
+func (q packageQueue) Less(i, j int) bool {
+	left, right := q[i].fee*q[j].size, q[j].fee*q[i].size
+	if left != right {
+		return left > right
+	}
+
+	return q[i].id < q[j].id
+}
+
+func (q packageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packageQueue) Push(x interface{}) { *q = append(*q, x.(packageRank)) }
+
+func (q *packageQueue) Pop() interface{} {
+	old := *q
+	rank := old[len(old)-1]
+	*q = old[:len(old)-1]
+
+	return rank
+}
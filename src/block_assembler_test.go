@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// assemblerPool pools a parent paying no fee, transactions paying 2 and 1 and a child of the
+// parent paying 6, in that order of arrival
+func assemblerPool(t *testing.T) (*Blockchain, *Wallet, *Mempool, map[string]string) {
+	t.Helper()
+
+	bc, wallet := testChain(t)
+	var coinbases []*Transaction
+	for i := 0; i < 3; i++ {
+		coinbases = append(coinbases, testMine(t, bc, wallet).Transactions[0])
+	}
+	value := coinbases[0].Vout[0].Value
+
+	parent := testSpend(wallet, coinbases[0], 0, value)
+	child := testSpend(wallet, parent, 0, value-6)
+	mid := testSpend(wallet, coinbases[1], 0, value-2)
+	low := testSpend(wallet, coinbases[2], 0, value-1)
+
+	mp := NewMempool(maxMempoolSize, time.Hour)
+	addAll(t, mp, bc, parent, mid, low, child)
+	names := map[string]string{parent.ID: "parent", child.ID: "child", mid.ID: "mid", low.ID: "low"}
+
+	return bc, wallet, mp, names
+}
+
+func txNames(txs []*Transaction, names map[string]string) []string {
+	var result []string
+	for _, tx := range txs {
+		result = append(result, names[tx.ID])
+	}
+
+	return result
+}
+
+func TestAssembleChildPaysForParent(t *testing.T) {
+	bc, wallet, mp, names := assemblerPool(t)
+
+	txs, fees := NewBlockAssembler(DefaultBlockPolicy()).Assemble(mp)
+	want := []string{"parent", "child", "mid", "low"}
+	if got := txNames(txs, names); !reflect.DeepEqual(got, want) || fees != 9 {
+		t.Errorf("assembled %v paying %d, want %v paying 9", got, fees, want)
+	}
+
+	// the block is valid with the parent ahead of its child
+	if _, err := bc.MineBlock(context.Background(), string(wallet.GetAddress()), txs, fees); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssemblePackageWeight(t *testing.T) {
+	_, _, mp, names := assemblerPool(t)
+
+	// room for two transactions: the parent and child package pays more than the other two
+	var weight int
+	for _, entry := range mp.snapshot() {
+		if entry.Weight > weight {
+			weight = entry.Weight
+		}
+	}
+	policy := DefaultBlockPolicy()
+	policy.MaxWeight = blockReservedWeight + 2*weight
+
+	txs, fees := NewBlockAssembler(policy).Assemble(mp)
+	want := []string{"parent", "child"}
+	if got := txNames(txs, names); !reflect.DeepEqual(got, want) || fees != 6 {
+		t.Errorf("assembled %v paying %d, want %v paying 6", got, fees, want)
+	}
+
+	policy.Order = SelectByArrival
+	txs, fees = NewBlockAssembler(policy).Assemble(mp)
+	want = []string{"parent", "mid"}
+	if got := txNames(txs, names); !reflect.DeepEqual(got, want) || fees != 2 {
+		t.Errorf("by arrival: assembled %v paying %d, want %v paying 2", got, fees, want)
+	}
+}
+
+func TestAssembleDeterministic(t *testing.T) {
+	bc, wallet := testChain(t)
+	mp := NewMempool(maxMempoolSize, time.Hour)
+
+	// transactions paying the same fee rate, which only their order of arrival tells apart
+	for i := 0; i < 8; i++ {
+		coinbase := testMine(t, bc, wallet).Transactions[0]
+		addAll(t, mp, bc, testSpend(wallet, coinbase, 0, coinbase.Vout[0].Value-1))
+	}
+
+	for _, order := range []SelectionOrder{SelectByFeeRate, SelectByArrival} {
+		policy := DefaultBlockPolicy()
+		policy.Order = order
+		policy.MaxTxs = 5
+		first, _ := NewBlockAssembler(policy).Assemble(mp)
+		for i := 0; i < 20; i++ {
+			txs, _ := NewBlockAssembler(policy).Assemble(mp)
+			if !reflect.DeepEqual(txs, first) {
+				t.Fatalf("%s: assembling the same mempool gave different blocks", order)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// blockDownloadWindow bounds how far past the first missing block requests go, which
+// bounds the downloaded blocks waiting for their parent
+const blockDownloadWindow = 128
+const maxBlocksInFlightPerPeer = 16
+
+// blockDownloadTimeout is how long a peer has to deliver a requested block before it is
+// disconnected and the block is asked from another peer
+const blockDownloadTimeout = 60 * time.Second
+const blockDownloadInterval = 5 * time.Second
+
+type blockRequest struct {
+	Peer      *Peer
+	Hash      []byte
+	Height    int
+	Requested time.Time
+}
+
+type downloadedBlock struct {
+	Block *Block
+	Peer  *Peer
+}
+
+// BlockDownloader fetches the blocks of the best header chain from several peers at once.
+// Requests stay within a window past the first missing block and the blocks arriving out
+// of order wait until their parent is stored.
+type BlockDownloader struct {
+	headers *HeaderChain
+	bc      *Blockchain
+
+	mutex    sync.Mutex
+	target   string
+	queue    []*headerNode
+	inFlight map[string]*blockRequest
+	received map[string]*downloadedBlock
+
+	connectMutex sync.Mutex
+}
+
+func NewBlockDownloader(headers *HeaderChain, bc *Blockchain) *BlockDownloader {
+	return &BlockDownloader{
+		headers:  headers,
+		bc:       bc,
+		inFlight: make(map[string]*blockRequest),
+		received: make(map[string]*downloadedBlock),
+	}
+}
+
+// Schedule drops the requests of peers that are gone or too slow and spreads the missing
+// blocks of the window over the candidate peers, least busy first. It returns the requests
+// to send.
+func (d *BlockDownloader) Schedule(candidates []*Peer) []*blockRequest {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.refresh()
+	now := time.Now()
+
+	load := make(map[*Peer]int)
+	for hash, request := range d.inFlight {
+		if request.Peer.Closed() {
+			delete(d.inFlight, hash)
+			continue
+		}
+		if now.Sub(request.Requested) > blockDownloadTimeout {
+			fmt.Printf("Disconnecting %s: block %x was not delivered within %s\n", request.Peer, hash, blockDownloadTimeout)
+			request.Peer.Close()
+			delete(d.inFlight, hash)
+			continue
+		}
+		load[request.Peer]++
+	}
+
+	window := d.queue
+	if len(window) > blockDownloadWindow {
+		window = window[:blockDownloadWindow]
+	}
+
+	var requests []*blockRequest
+	for _, node := range window {
+		if _, ok := d.inFlight[node.Hash]; ok {
+			continue
+		}
+		if _, ok := d.received[node.Hash]; ok || d.bc.HasBlock([]byte(node.Hash)) {
+			continue
+		}
+
+		var peer *Peer
+		for _, p := range candidates {
+			if p.Closed() || p.BestHeight() < node.Height || load[p] >= maxBlocksInFlightPerPeer {
+				continue
+			}
+			if peer == nil || load[p] < load[peer] {
+				peer = p
+			}
+		}
+		// the next blocks are higher, no peer has them either
+		if peer == nil {
+			break
+		}
+
+		request := &blockRequest{peer, []byte(node.Hash), node.Height, now}
+		d.inFlight[node.Hash] = request
+		load[peer]++
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+// Received keeps a block the downloader requested until it can be connected and reports
+// whether the block was requested. The block must hash to the requested header and sit at
+// its height, which the hash does not cover, so a peer cannot get a header invalidated by
+// sending something else under its hash.
+func (d *BlockDownloader) Received(block *Block, from *Peer) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	request, ok := d.inFlight[block.Hash]
+	if !ok || request.Peer != from {
+		return false
+	}
+	if !bytes.Equal(headerHash(block.BlockHeader), []byte(block.Hash)) || block.Height != request.Height {
+		return false
+	}
+	delete(d.inFlight, block.Hash)
+	d.received[block.Hash] = &downloadedBlock{block, from}
+
+	return true
+}
+
+// Connect hands the downloaded blocks whose parent is stored to connect, parents first.
+// Only one goroutine connects at a time so the blocks are added in order.
+func (d *BlockDownloader) Connect(connect func(block *Block, peer *Peer)) {
+	d.connectMutex.Lock()
+	defer d.connectMutex.Unlock()
+
+	for {
+		d.mutex.Lock()
+		d.refresh()
+		var next *downloadedBlock
+		if len(d.queue) > 0 {
+			next = d.received[d.queue[0].Hash]
+			delete(d.received, d.queue[0].Hash)
+		}
+		d.mutex.Unlock()
+
+		if next == nil {
+			return
+		}
+		connect(next.Block, next.Peer)
+	}
+}
+
+// refresh follows the best header and skips the blocks stored since the last call, the
+// mutex must be held
+func (d *BlockDownloader) refresh() {
+	if best := d.headers.Best(); best.Hash != d.target {
+		d.target = best.Hash
+		d.queue = d.headers.Missing(best.Hash)
+
+		wanted := make(map[string]bool)
+		for _, node := range d.queue {
+			wanted[node.Hash] = true
+		}
+		for hash := range d.received {
+			if !wanted[hash] {
+				delete(d.received, hash)
+			}
+		}
+	}
+
+	for len(d.queue) > 0 && d.bc.HasBlock([]byte(d.queue[0].Hash)) {
+		d.queue = d.queue[1:]
+	}
+}
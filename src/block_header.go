@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Blocks before this version hash a formatted string of their fields instead of their header
+const headerHashVersion = 2
+
+// nonceLength is the size of the nonce, which the header serialization ends with
+const nonceLength = 8
+
+// BlockHeader holds the fields the block hash commits to. The transactions are committed
+// to through the Merkle root.
+type BlockHeader struct {
+	Version      int
+	PreviousHash string
+	MerkleRoot   string
+	Timestamp    int64
+	Bits         uint32
+	Nonce        int
+}
+
+// Serialize returns the canonical encoding of the header, which is what the block hash is taken over
+func (h *BlockHeader) Serialize() []byte {
+	w := newBinaryWriter(h.Version)
+	h.write(w)
+
+	return w.Bytes()
+}
+
+func (h *BlockHeader) write(w *binaryWriter) {
+	w.writeHash(h.PreviousHash)
+	w.writeHash(h.MerkleRoot)
+	w.writeVarint(h.Timestamp)
+	w.writeUint32(h.Bits)
+	w.writeUint64(uint64(h.Nonce))
+}
+
+func readBlockHeader(r *binaryReader, version int) BlockHeader {
+	h := BlockHeader{Version: version}
+
+	h.PreviousHash = r.readHash()
+	h.MerkleRoot = r.readHash()
+	h.Timestamp = r.readVarint()
+	h.Bits = r.readUint32()
+	h.Nonce = int(r.readUint64())
+
+	return h
+}
+
+// checkRelayedVersion refuses the block versions peers may not send. Blocks older than
+// headerHashVersion carry their own hash, which nothing checks before validation, and newer
+// versions than blockVersion are not understood.
+func checkRelayedVersion(version int) error {
+	if version < headerHashVersion || version > blockVersion {
+		return fmt.Errorf("unsupported block version %d", version)
+	}
+
+	return nil
+}
+
+// DeserializeBlockHeader decodes a header encoded by BlockHeader.Serialize
+func DeserializeBlockHeader(data []byte) (BlockHeader, error) {
+	r, version := newBinaryReader(data)
+	h := readBlockHeader(r, version)
+
+	return h, r.finish()
+}
+
+// Hash returns the hash of the serialized header
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+
+	return hash[:]
+}
+
+// setNonce overwrites the nonce at the end of a serialized header
+func setNonce(header []byte, nonce int) {
+	binary.LittleEndian.PutUint64(header[len(header)-nonceLength:], uint64(nonce))
+}
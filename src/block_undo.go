@@ -0,0 +1,70 @@
+package main
+
+import "log"
+
+const undoBucket = "undo"
+const undoVersion = 1
+
+// SpentOutput is an output that was removed from the UTXO set by a block
+type SpentOutput struct {
+	TxID     string
+	Index    int
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// BlockUndo lists the outputs spent by a block in the order they were spent
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (u BlockUndo) Serialize() []byte {
+	w := newBinaryWriter(undoVersion)
+
+	w.writeUvarint(uint64(len(u.Spent)))
+	for _, spent := range u.Spent {
+		w.writeHash(spent.TxID)
+		w.writeVarint(int64(spent.Index))
+		w.writeVarint(int64(spent.Output.Value))
+		w.writeBytes(spent.Output.PubKeyHash)
+		w.writeVarint(int64(spent.Height))
+		w.writeBool(spent.Coinbase)
+	}
+
+	return w.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	var err error
+
+	if isCanonical(data) {
+		undo, err = readBlockUndo(data)
+	} else {
+		undo, err = decodeLegacyBlockUndo(data)
+	}
+	if err != nil {
+		log.Panic("ERROR: error while decoding undo data: ", err)
+	}
+
+	return undo
+}
+
+func readBlockUndo(data []byte) (BlockUndo, error) {
+	r, _ := newBinaryReader(data)
+	var undo BlockUndo
+
+	for i, n := 0, r.readCount(hashLength+5); i < n; i++ {
+		var spent SpentOutput
+		spent.TxID = r.readHash()
+		spent.Index = r.readInt()
+		spent.Output.Value = r.readInt()
+		spent.Output.PubKeyHash = r.readBytes()
+		spent.Height = r.readInt()
+		spent.Coinbase = r.readBool()
+		undo.Spent = append(undo.Spent, spent)
+	}
+
+	return undo, r.finish()
+}
@@ -2,21 +2,32 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
+	"math/big"
 	"os"
+	"sync"
 )
 
 const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
+const tipsBucket = "tips"
+const chainWorkBucket = "chainwork"
+
+// heightsBucket maps the heights of the active chain to the hashes of its blocks
+const heightsBucket = "heights"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks" // BC genesis block data
 
 type Blockchain struct {
 	Tip []byte
 	DB  *bolt.DB
+
+	tipMutex   sync.Mutex
+	tipChanged chan struct{}
 }
 
 // NewBlockchain creates a new blockchain starting with the genesis block
@@ -35,14 +46,41 @@ func NewBlockchain(nodeID string) *Blockchain {
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		// the value is only valid until the transaction ends
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+
+		if _, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket)); err != nil {
+			return err
+		}
+
+		tips, err := tx.CreateBucketIfNotExists([]byte(tipsBucket))
+		if err != nil {
+			return err
+		}
+		if k, _ := tips.Cursor().First(); k == nil {
+			if err := tips.Put(tip, []byte{}); err != nil {
+				return err
+			}
+		}
+
+		// databases created before the height index get it built once
+		heights, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+		if err != nil {
+			return err
+		}
+		if k, _ := heights.Cursor().First(); k == nil {
+			for block := getBlock(b, tip); block != nil; block = getBlock(b, []byte(block.PreviousHash)) {
+				setActiveHeight(tx, block)
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
 		log.Panic("ERROR: error while updating blockchain: ", err)
 	}
 
-	return &Blockchain{tip, db}
+	return &Blockchain{Tip: tip, DB: db}
 }
 
 // CreateBlockchain creates a new blockchain DB
@@ -53,13 +91,13 @@ func CreateBlockchain(address string, nodeID string) *Blockchain {
 		os.Exit(1)
 	}
 
-	db := initializeDB()
+	db := initializeDB(dbFile)
 	tip := createGenesisBlock(db, address)
 
-	return &Blockchain{tip, db}
+	return &Blockchain{Tip: tip, DB: db}
 }
 
-func initializeDB() *bolt.DB {
+func initializeDB(dbFile string) *bolt.DB {
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
 		log.Panic(err)
@@ -77,8 +115,24 @@ func createGenesisBlock(db *bolt.DB, address string) []byte {
 		if err != nil {
 			log.Panic(err)
 		}
+		if _, err = tx.CreateBucket([]byte(tipsBucket)); err != nil {
+			log.Panic(err)
+		}
+		if _, err = tx.CreateBucket([]byte(chainWorkBucket)); err != nil {
+			log.Panic(err)
+		}
+		if _, err = tx.CreateBucket([]byte(utxoBucket)); err != nil {
+			log.Panic(err)
+		}
+		if _, err = tx.CreateBucket([]byte(heightsBucket)); err != nil {
+			log.Panic(err)
+		}
 
 		storeBlock(b, genesis)
+		setActiveHeight(tx, genesis)
+		storeChainWork(tx, genesis)
+		updateTips(tx, genesis)
+		UTXOSet{}.connect(tx, genesis)
 		tip = []byte(genesis.Hash)
 
 		return nil
@@ -91,7 +145,7 @@ func createGenesisBlock(db *bolt.DB, address string) []byte {
 }
 
 func createGenesisTransaction(address string) *Block {
-	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 	return NewGenesisBlock(cbtx)
 }
 
@@ -105,7 +159,7 @@ func storeBlock(bucket *bolt.Bucket, block *Block) {
 }
 
 func (bc *Blockchain) Iterator() *BlockchainIterator {
-	return &BlockchainIterator{string(bc.Tip), bc.DB}
+	return &BlockchainIterator{string(bc.TipHash()), bc.DB}
 }
 
 func dbExists(dbFile string) bool {
@@ -116,58 +170,114 @@ func dbExists(dbFile string) bool {
 	return true
 }
 
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get([]byte(block.Hash))
+// AddBlock validates and stores a block and makes the branch with the most cumulative work
+// the active chain. It returns the transactions of disconnected blocks that should go back
+// to the mempool. Invalid blocks are refused with a *BlockValidationError.
+func (bc *Blockchain) AddBlock(block *Block) ([]*Transaction, error) {
+	var readmitted []*Transaction
+	var newTip []byte
 
-		if blockInDb != nil {
-			return nil
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if err := ValidateBlock(tx, block); err != nil {
+			return err
 		}
 
+		b := tx.Bucket([]byte(blocksBucket))
 		blockData := block.Serialize()
 		err := b.Put([]byte(block.Hash), blockData)
 		if err != nil {
 			log.Panic(err)
 		}
+		storeChainWork(tx, block)
+		updateTips(tx, block)
 
 		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		bestHash := findBestTip(tx, lastHash)
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), []byte(block.Hash))
-			if err != nil {
-				log.Panic(err)
+		if bytes.Compare(bestHash, lastHash) != 0 {
+			readmitted, err = bc.reorganize(tx, lastHash, bestHash)
+			if err == nil {
+				newTip = append([]byte{}, bestHash...)
 			}
-			bc.Tip = []byte(block.Hash)
 		}
 
-		return nil
+		return err
 	})
-	if err != nil {
-		log.Panic(err)
+
+	if err == nil && newTip != nil {
+		bc.moveTip(newTip)
 	}
+
+	return readmitted, err
 }
 
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	validateTransactions(transactions, bc)
+// TipChanged returns a channel that is closed the next time the active chain tip moves
+func (bc *Blockchain) TipChanged() <-chan struct{} {
+	bc.tipMutex.Lock()
+	defer bc.tipMutex.Unlock()
 
-	lastHash, lastHeight := bc.getLastBlockHash()
+	if bc.tipChanged == nil {
+		bc.tipChanged = make(chan struct{})
+	}
+
+	return bc.tipChanged
+}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+// TipHash returns the hash of the active chain tip
+func (bc *Blockchain) TipHash() []byte {
+	bc.tipMutex.Lock()
+	defer bc.tipMutex.Unlock()
 
-	bc.saveBlock(newBlock)
+	return append([]byte{}, bc.Tip...)
+}
+
+// moveTip records the new tip once it is committed and wakes up the TipChanged waiters
+func (bc *Blockchain) moveTip(tip []byte) {
+	bc.tipMutex.Lock()
+	defer bc.tipMutex.Unlock()
 
-	return newBlock
+	bc.Tip = append([]byte{}, tip...)
+	if bc.tipChanged != nil {
+		close(bc.tipChanged)
+		bc.tipChanged = nil
+	}
 }
 
-func validateTransactions(transactions []*Transaction, bc *Blockchain) {
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("ERROR: Invalid transaction")
+// MineBlock mines a block with the transactions on top of the current tip, led by a
+// coinbase paying the subsidy and fees to address. Mining stops with an error when ctx is
+// done or when the tip moves, since the block would be stale. The block is refused if the
+// tip moved after the transactions were picked and it made some of them invalid.
+func (bc *Blockchain) MineBlock(ctx context.Context, address string, transactions []*Transaction, fees int) (*Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tipChanged := bc.TipChanged()
+	go func() {
+		select {
+		case <-tipChanged:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+
+	// the coinbase height has to match the tip the block is built on
+	lastHash, lastHeight := bc.getLastBlockHash()
+	cbTx := NewCoinbaseTX(address, "", lastHeight+1, fees)
+	transactions = append([]*Transaction{cbTx}, transactions...)
+	newBlock := newUnminedBlock(transactions, lastHash, lastHeight+1, bc.NextBits(lastHash))
+	if err := checkBlockLimits(newBlock); err != nil {
+		return nil, err
+	}
+
+	if err := NewMiner(miningThreads).Mine(ctx, newBlock); err != nil {
+		return nil, err
+	}
+
+	if _, err := bc.AddBlock(newBlock); err != nil {
+		return nil, err
 	}
+
+	return newBlock, nil
 }
 
 func (bc *Blockchain) getLastBlockHash() ([]byte, int) {
@@ -176,7 +286,7 @@ func (bc *Blockchain) getLastBlockHash() ([]byte, int) {
 
 	err := bc.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
 
 		blockData := b.Get(lastHash)
 		block := DeserializeBlock(blockData)
@@ -192,23 +302,46 @@ func (bc *Blockchain) getLastBlockHash() ([]byte, int) {
 	return lastHash, lastHeight
 }
 
-func (bc *Blockchain) saveBlock(block *Block) {
-	err := bc.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
+// NextBits returns the difficulty of the block that will follow the given block
+func (bc *Blockchain) NextBits(parentHash []byte) uint32 {
+	var bits uint32
 
-		if err := b.Put([]byte(block.Hash), block.Serialize()); err != nil {
-			log.Panic(err)
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		parent := getBlock(b, parentHash)
+		if parent == nil {
+			return errors.New("block is not found")
 		}
-		if err := b.Put([]byte("l"), []byte(block.Hash)); err != nil {
-			log.Panic(err)
+
+		bits = nextBits(b, parent)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return bits
+}
+
+// MedianTimePast returns the earliest timestamp a child of the given block may have
+func (bc *Blockchain) MedianTimePast(parentHash []byte) int64 {
+	var mtp int64
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		parent := getBlock(b, parentHash)
+		if parent == nil {
+			return errors.New("block is not found")
 		}
 
-		bc.Tip = []byte(block.Hash)
+		mtp = medianTimePast(b, parent)
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+
+	return mtp
 }
 
 func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
@@ -220,7 +353,7 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 		block := bci.Next()
 
 		for _, tx := range block.Transactions {
-			checkOutputs(tx, UTXO, spentTXOs)
+			checkOutputs(tx, block.Height, UTXO, spentTXOs)
 
 			if !tx.IsCoinbase() {
 				markSpentOutputs(tx, spentTXOs)
@@ -235,14 +368,19 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 	return UTXO
 }
 
-func checkOutputs(tx *Transaction, UTXO map[string]TXOutputs, spentTXOs map[string][]int) {
+func checkOutputs(tx *Transaction, height int, UTXO map[string]TXOutputs, spentTXOs map[string][]int) {
 	for outIdx, out := range tx.Vout {
 		if isOutputSpent(tx.ID, outIdx, spentTXOs) {
 			continue
 		}
 
-		outs := UTXO[tx.ID]
-		outs.Outputs = append(outs.Outputs, out)
+		outs, ok := UTXO[tx.ID]
+		if !ok {
+			outs = NewTXOutputs()
+			outs.Height = height
+			outs.Coinbase = tx.IsCoinbase()
+		}
+		outs.Outputs[outIdx] = out
 		UTXO[tx.ID] = outs
 	}
 }
@@ -283,30 +421,38 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 }
 
 func (bc *Blockchain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
-	prevTXs := bc.getPreviousTransactions(tx)
+	prevTXs, err := bc.getPreviousTransactions(tx)
+	if err != nil {
+		log.Panic("ERROR: Failed to find previous transaction: ", err)
+	}
 	tx.Sign(privateKey, prevTXs)
 }
 
+// VerifyTransaction checks the signatures of a transaction spending confirmed outputs. It
+// returns false when a previous transaction is not in the chain.
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
-	prevTXs := bc.getPreviousTransactions(tx)
+	prevTXs, err := bc.getPreviousTransactions(tx)
+	if err != nil {
+		return false
+	}
 	return tx.Verify(prevTXs)
 }
 
-func (bc *Blockchain) getPreviousTransactions(tx *Transaction) map[string]Transaction {
+func (bc *Blockchain) getPreviousTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
 		prevTX, err := bc.FindTransaction([]byte(vin.TxID))
 		if err != nil {
-			log.Panic("ERROR: Failed to find previous transaction: ", err)
+			return nil, err
 		}
 		prevTXs[prevTX.ID] = prevTX
 	}
 
-	return prevTXs
+	return prevTXs, nil
 }
 
 func (bc *Blockchain) GetBestHeight() int {
@@ -327,6 +473,23 @@ func (bc *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
+// GetBestChainWork returns the cumulative work of the active chain
+func (bc *Blockchain) GetBestChainWork() *big.Int {
+	var work *big.Int
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		lastHash := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		work = chainWork(tx, lastHash)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return work
+}
+
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
@@ -350,6 +513,76 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
+// HasBlock reports whether the block is stored, on the active chain or not
+func (bc *Blockchain) HasBlock(blockHash []byte) bool {
+	var found bool
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(blocksBucket)).Get(blockHash) != nil
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return found
+}
+
+// GetChainWork returns the cumulative work of the chain ending with the block, or nil when
+// the block is not known
+func (bc *Blockchain) GetChainWork(blockHash []byte) *big.Int {
+	var work *big.Int
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		work = chainWork(tx, blockHash)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return work
+}
+
+// LocateHeaders returns the headers of the active chain that follow the first locator hash
+// found on it, up to stopHash or max headers. Without a match they follow the genesis block.
+func (bc *Blockchain) LocateHeaders(locator [][]byte, stopHash []byte, max int) []BlockHeader {
+	var headers []BlockHeader
+
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		start := 0
+		for _, hash := range locator {
+			if block := getBlock(b, hash); block != nil && bytes.Equal(activeHash(tx, block.Height), hash) {
+				start = block.Height
+				break
+			}
+		}
+
+		for height := start + 1; len(headers) < max; height++ {
+			hash := activeHash(tx, height)
+			if hash == nil {
+				break
+			}
+			headers = append(headers, getBlock(b, hash).BlockHeader)
+
+			if bytes.Equal(hash, stopHash) {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return headers
+}
+
 func (bc *Blockchain) GetBlockHashes() [][]byte {
 	var blocks [][]byte
 	bci := bc.Iterator()
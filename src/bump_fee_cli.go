@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+// bumpFee replaces an unconfirmed transaction sent from the wallet with a copy paying the
+// higher fee out of its change
+func (cli *CLI) bumpFee(txID string, fee int, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, ok := wallets.GetTransaction(txID)
+	if !ok {
+		log.Panic("ERROR: The wallet did not send an unconfirmed transaction with this ID")
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer func(DB *bolt.DB) {
+		err := DB.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}(bc.DB)
+
+	if _, err := bc.FindTransaction([]byte(tx.ID)); err == nil {
+		wallets.ForgetTransaction(txID)
+		wallets.SaveToFile(nodeID)
+		log.Panic("ERROR: The transaction is already confirmed")
+	}
+
+	from, wallet, ok := wallets.FindWallet(tx.Vin[0].PubKey)
+	if !ok {
+		log.Panic("ERROR: The transaction does not spend coins of this wallet")
+	}
+
+	prevTXs, err := bc.getPreviousTransactions(tx)
+	if err != nil {
+		log.Panic("ERROR: Failed to find previous transaction: ", err)
+	}
+	oldFee := 0
+	for _, vin := range tx.Vin {
+		oldFee += prevTXs[vin.TxID].Vout[vin.Vout].Value
+	}
+	for _, out := range tx.Vout {
+		oldFee -= out.Value
+	}
+	if fee <= oldFee {
+		log.Panicf("ERROR: The new fee must be higher than %d", oldFee)
+	}
+
+	// the change is the output paying the sender after the one paying the recipient
+	change := len(tx.Vout) - 1
+	if change < 1 || !tx.Vout[change].IsLockedWithKey(HashPubKey(wallet.PublicKey)) {
+		log.Panic("ERROR: The transaction has no change to pay a higher fee with")
+	}
+	if tx.Vout[change].Value < fee-oldFee {
+		log.Panic("ERROR: The change is too small to pay the new fee")
+	}
+
+	bumped := &Transaction{"", nil, nil, transactionVersion}
+	for _, vin := range tx.Vin {
+		bumped.Vin = append(bumped.Vin, TXInput{vin.TxID, vin.Vout, nil, vin.PubKey})
+	}
+	bumped.Vout = append(bumped.Vout, tx.Vout...)
+	bumped.Vout[change].Value -= fee - oldFee
+	if bumped.Vout[change].Value == 0 {
+		bumped.Vout = bumped.Vout[:change]
+	}
+
+	bumped.Sign(wallet.PrivateKey, prevTXs)
+	bumped.ID = string(bumped.Hash())
+
+	broadcastTransaction(bumped)
+
+	wallets.ForgetTransaction(txID)
+	wallets.RecordTransaction(bumped)
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Replaced transaction %s from %s with %x paying a fee of %d\n", txID, from, bumped.ID, fee)
+}
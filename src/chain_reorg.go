@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math/big"
+)
+
+// updateTips records the block as a branch tip in place of its parent
+func updateTips(tx *bolt.Tx, block *Block) {
+	tips := tx.Bucket([]byte(tipsBucket))
+
+	if len(block.PreviousHash) > 0 {
+		if err := tips.Delete([]byte(block.PreviousHash)); err != nil {
+			log.Panic(err)
+		}
+	}
+	if err := tips.Put([]byte(block.Hash), []byte{}); err != nil {
+		log.Panic(err)
+	}
+}
+
+// findBestTip returns the branch tip with the most cumulative work. The current tip wins ties.
+func findBestTip(tx *bolt.Tx, currentTip []byte) []byte {
+	c := tx.Bucket([]byte(tipsBucket)).Cursor()
+
+	bestHash := currentTip
+	bestWork := chainWork(tx, currentTip)
+
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		work := chainWork(tx, k)
+		if work != nil && work.Cmp(bestWork) > 0 {
+			bestHash = k
+			bestWork = work
+		}
+	}
+
+	return bestHash
+}
+
+// storeChainWork records the cumulative work of the chain ending with the block,
+// the equivalent of Bitcoin's nChainWork
+func storeChainWork(tx *bolt.Tx, block *Block) {
+	work := NewProofOfWork(block).Work()
+
+	if len(block.PreviousHash) > 0 {
+		parentWork := chainWork(tx, []byte(block.PreviousHash))
+		if parentWork == nil {
+			log.Panicf("ERROR: chain work of %x is not known", block.PreviousHash)
+		}
+		work.Add(work, parentWork)
+	}
+
+	err := tx.Bucket([]byte(chainWorkBucket)).Put([]byte(block.Hash), work.Bytes())
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// chainWork returns the cumulative work of the chain ending with the block. Blocks stored
+// before chain work was recorded are summed up to the nearest ancestor that has it.
+// It returns nil when the branch is not connected to the genesis block.
+func chainWork(tx *bolt.Tx, hash []byte) *big.Int {
+	b := tx.Bucket([]byte(blocksBucket))
+	works := tx.Bucket([]byte(chainWorkBucket))
+	work := big.NewInt(0)
+
+	for {
+		if stored := works.Get(hash); stored != nil {
+			return work.Add(work, new(big.Int).SetBytes(stored))
+		}
+
+		block := getBlock(b, hash)
+		if block == nil {
+			return nil
+		}
+
+		work.Add(work, NewProofOfWork(block).Work())
+
+		if len(block.PreviousHash) == 0 {
+			return work
+		}
+		hash = []byte(block.PreviousHash)
+	}
+}
+
+// reorganize switches the active chain from oldTip to newTip. Blocks down to the
+// common ancestor are disconnected from the UTXO set and the new branch is validated
+// and connected. On error the caller must roll the bolt transaction back, otherwise it
+// moves bc.Tip once the transaction is committed.
+func (bc *Blockchain) reorganize(tx *bolt.Tx, oldTip, newTip []byte) ([]*Transaction, error) {
+	b := tx.Bucket([]byte(blocksBucket))
+	UTXOSet := UTXOSet{bc}
+
+	detached, attached := findFork(b, oldTip, newTip)
+	if len(detached) > 0 {
+		fmt.Printf("Reorganizing: disconnecting %d blocks, connecting %d blocks\n", len(detached), len(attached))
+	}
+
+	var disconnected []*Transaction
+	for _, block := range detached {
+		UTXOSet.disconnect(tx, block)
+		unsetActiveHeight(tx, block)
+
+		for _, transaction := range block.Transactions {
+			if !transaction.IsCoinbase() {
+				disconnected = append(disconnected, transaction)
+			}
+		}
+	}
+
+	for i := len(attached) - 1; i >= 0; i-- {
+		if err := checkBlockTransactions(tx, attached[i]); err != nil {
+			return nil, err
+		}
+		UTXOSet.connect(tx, attached[i])
+		setActiveHeight(tx, attached[i])
+	}
+
+	if err := b.Put([]byte("l"), newTip); err != nil {
+		log.Panic(err)
+	}
+
+	return readmittable(tx, disconnected, attached), nil
+}
+
+// findFork walks both branches back to their common ancestor. Both returned slices are ordered tip first.
+func findFork(b *bolt.Bucket, oldTip, newTip []byte) ([]*Block, []*Block) {
+	var detached, attached []*Block
+
+	oldBlock := getBlock(b, oldTip)
+	newBlock := getBlock(b, newTip)
+
+	for oldBlock.Hash != newBlock.Hash {
+		if oldBlock.Height >= newBlock.Height {
+			detached = append(detached, oldBlock)
+			oldBlock = getBlock(b, []byte(oldBlock.PreviousHash))
+		} else {
+			attached = append(attached, newBlock)
+			newBlock = getBlock(b, []byte(newBlock.PreviousHash))
+		}
+
+		if oldBlock == nil || newBlock == nil {
+			log.Panic("ERROR: branches have no common ancestor")
+		}
+	}
+
+	return detached, attached
+}
+
+// readmittable filters the disconnected transactions down to the ones that were not
+// included in the new branch and whose inputs are still unspent
+func readmittable(tx *bolt.Tx, disconnected []*Transaction, attached []*Block) []*Transaction {
+	utxo := tx.Bucket([]byte(utxoBucket))
+	included := make(map[string]bool)
+	pending := make(map[string]bool)
+
+	for _, block := range attached {
+		for _, transaction := range block.Transactions {
+			included[transaction.ID] = true
+		}
+	}
+
+	var result []*Transaction
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		transaction := disconnected[i]
+		if included[transaction.ID] {
+			continue
+		}
+
+		spendable := true
+		for _, vin := range transaction.Vin {
+			if pending[vin.TxID] {
+				continue
+			}
+
+			outsBytes := utxo.Get([]byte(vin.TxID))
+			if outsBytes == nil {
+				spendable = false
+				break
+			}
+			if _, ok := DeserializeOutputs(outsBytes).Outputs[vin.Vout]; !ok {
+				spendable = false
+				break
+			}
+		}
+
+		if spendable {
+			pending[transaction.ID] = true
+			result = append(result, transaction)
+		}
+	}
+
+	return result
+}
+
+func getBlock(b *bolt.Bucket, hash []byte) *Block {
+	if len(hash) == 0 {
+		return nil
+	}
+
+	blockData := b.Get(hash)
+	if blockData == nil {
+		return nil
+	}
+
+	return DeserializeBlock(blockData)
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+
+	return key
+}
+
+// setActiveHeight records the block as the one at its height on the active chain
+func setActiveHeight(tx *bolt.Tx, block *Block) {
+	if err := tx.Bucket([]byte(heightsBucket)).Put(heightKey(block.Height), []byte(block.Hash)); err != nil {
+		log.Panic(err)
+	}
+}
+
+// unsetActiveHeight removes a block disconnected from the active chain from the height index
+func unsetActiveHeight(tx *bolt.Tx, block *Block) {
+	heights := tx.Bucket([]byte(heightsBucket))
+	if !bytes.Equal(heights.Get(heightKey(block.Height)), []byte(block.Hash)) {
+		return
+	}
+	if err := heights.Delete(heightKey(block.Height)); err != nil {
+		log.Panic(err)
+	}
+}
+
+// activeHash returns the hash of the block at the height on the active chain, or nil above
+// the tip
+func activeHash(tx *bolt.Tx, height int) []byte {
+	return tx.Bucket([]byte(heightsBucket)).Get(heightKey(height))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// utxoSnapshot copies the encoded UTXO set
+func utxoSnapshot(t *testing.T, bc *Blockchain) map[string]string {
+	t.Helper()
+
+	snapshot := make(map[string]string)
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			snapshot[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+// checkReindexed compares the UTXO set with the one rebuilt from the active chain
+func checkReindexed(t *testing.T, bc *Blockchain) {
+	t.Helper()
+
+	utxo := utxoSnapshot(t, bc)
+	UTXOSet{bc}.Reindex()
+	if rebuilt := utxoSnapshot(t, bc); !reflect.DeepEqual(utxo, rebuilt) {
+		t.Errorf("the UTXO set has %d entries, %d after a reindex, or different outputs", len(utxo), len(rebuilt))
+	}
+}
+
+// testAddBlock mines a block on top of parent, which need not be the tip, and adds it
+func testAddBlock(t *testing.T, bc *Blockchain, wallet *Wallet, parent *Block, txs ...*Transaction) ([]*Transaction, *Block) {
+	t.Helper()
+
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", parent.Height+1, 0)
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), []byte(parent.Hash), parent.Height+1, bc.NextBits([]byte(parent.Hash)))
+	readmitted, err := bc.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return readmitted, block
+}
+
+func TestReorganization(t *testing.T) {
+	bc, wallet := testChain(t)
+	genesis, err := bc.GetBlock(bc.TipHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+
+	spend := testSpend(wallet, coinbase, 0, coinbase.Vout[0].Value-1)
+	_, main1 := testAddBlock(t, bc, wallet, &genesis, spend)
+	mainUTXO := utxoSnapshot(t, bc)
+
+	// a branch with as much work does not take over
+	_, fork1 := testAddBlock(t, bc, wallet, &genesis)
+	if !bytes.Equal(bc.TipHash(), []byte(main1.Hash)) {
+		t.Fatal("a branch with the same work became active")
+	}
+	if !reflect.DeepEqual(utxoSnapshot(t, bc), mainUTXO) {
+		t.Error("storing a side branch block changed the UTXO set")
+	}
+
+	readmitted, fork2 := testAddBlock(t, bc, wallet, fork1)
+	if !bytes.Equal(bc.TipHash(), []byte(fork2.Hash)) {
+		t.Fatal("the branch with more work did not become active")
+	}
+	if len(readmitted) != 1 || readmitted[0].ID != spend.ID {
+		t.Errorf("%d transactions readmitted, want the spend of the disconnected block", len(readmitted))
+	}
+	checkReindexed(t, bc)
+
+	// and back to the first branch, which confirms the spend again
+	_, main2 := testAddBlock(t, bc, wallet, main1)
+	readmitted, main3 := testAddBlock(t, bc, wallet, main2)
+	if !bytes.Equal(bc.TipHash(), []byte(main3.Hash)) {
+		t.Fatal("the first branch did not become active again")
+	}
+	if len(readmitted) != 0 {
+		t.Errorf("%d transactions readmitted, the branch blocks only had coinbases", len(readmitted))
+	}
+	utxo := utxoSnapshot(t, bc)
+	for txID, outputs := range mainUTXO {
+		if utxo[txID] != outputs {
+			t.Errorf("the outputs of %x differ from before the reorganizations", txID)
+		}
+	}
+	checkReindexed(t, bc)
+}
+
+func TestReorganizationToInvalidBranch(t *testing.T) {
+	bc, wallet := testChain(t)
+	genesis, err := bc.GetBlock(bc.TipHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, main1 := testAddBlock(t, bc, wallet, &genesis)
+	utxo := utxoSnapshot(t, bc)
+
+	// the branch block overpays its coinbase, which only shows once it is connected
+	_, fork1 := testAddBlock(t, bc, wallet, &genesis)
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "", 2, 1000)
+	fork2 := NewBlock([]*Transaction{coinbase}, []byte(fork1.Hash), 2, bc.NextBits([]byte(fork1.Hash)))
+	if _, err := bc.AddBlock(fork2); err == nil {
+		t.Fatal("a block overpaying its coinbase was accepted")
+	}
+
+	if !bytes.Equal(bc.TipHash(), []byte(main1.Hash)) {
+		t.Error("the tip moved to an invalid branch")
+	}
+	if !reflect.DeepEqual(utxoSnapshot(t, bc), utxo) {
+		t.Error("the UTXO set changed")
+	}
+}
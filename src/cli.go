@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 type CLI struct{}
@@ -17,30 +18,56 @@ func (cli *CLI) Run() {
 		fmt.Printf("NODE_ID env. var is not set!")
 		os.Exit(1)
 	}
+	loadChainParams()
 
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "The ID of the transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "The new fee, higher than the current one")
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee to pay to the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeThreads := startNodeCmd.Int("threads", miningThreads, "Number of mining threads")
+	startNodeRPCPort := startNodeCmd.String("rpcport", "", "Serve the mining and peer RPC interface on PORT")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", defaultMaxInbound, "Maximum number of peers connecting to the node")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", defaultMaxOutbound, "Maximum number of peers the node connects to")
+	startNodeMinTxs := startNodeCmd.Int("mintxs", 1, "Number of pending transactions that starts a block right away")
+	startNodeMaxTxs := startNodeCmd.Int("maxtxs", 0, "Maximum number of transactions in a mined block, 0 for no limit")
+	startNodeBlockMaxWeight := startNodeCmd.Int("blockmaxweight", maxBlockWeight, "Maximum weight of a mined block")
+	startNodeBlockOrder := startNodeCmd.String("blockorder", SelectByFeeRate.String(), "Order transactions enter a mined block: feerate or arrival")
+	startNodeBlockInterval := startNodeCmd.Int64("blockinterval", chainParams.TargetBlockTime, "Seconds after the last block to mine without waiting for transactions")
 
 	switch os.Args[1] {
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -56,6 +83,11 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -81,6 +113,14 @@ func (cli *CLI) Run() {
 		os.Exit(1)
 	}
 
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
@@ -89,6 +129,10 @@ func (cli *CLI) Run() {
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(nodeID)
+	}
+
 	if createBlockchainCmd.Parsed() {
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
@@ -105,6 +149,10 @@ func (cli *CLI) Run() {
 		cli.listAddresses(nodeID)
 	}
 
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB(nodeID)
+	}
+
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
@@ -114,21 +162,37 @@ func (cli *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine)
 	}
 
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
-		if nodeID == "" {
+		blockOrder, err := ParseSelectionOrder(*startNodeBlockOrder)
+		if nodeID == "" || *startNodeThreads < 1 || *startNodeMinTxs < 0 || *startNodeMaxTxs < 0 || *startNodeBlockInterval < 0 ||
+			*startNodeBlockMaxWeight <= blockReservedWeight || *startNodeBlockMaxWeight > maxBlockWeight || err != nil ||
+			*startNodeMaxInbound < 0 || *startNodeMaxOutbound < 0 {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		miningThreads = *startNodeThreads
+		peers.MaxInbound = *startNodeMaxInbound
+		peers.MaxOutbound = *startNodeMaxOutbound
+		policy := DefaultBlockPolicy()
+		policy.MaxWeight = *startNodeBlockMaxWeight
+		policy.MaxTxs = *startNodeMaxTxs
+		policy.Order = blockOrder
+		miner := MinerConfig{
+			Address:       *startNodeMiner,
+			MinTxs:        *startNodeMinTxs,
+			BlockInterval: time.Duration(*startNodeBlockInterval) * time.Second,
+			Policy:        policy,
+		}
+		cli.startNode(nodeID, miner, *startNodeRPCPort)
 	}
 }
 
@@ -142,9 +206,17 @@ func (cli *CLI) validateArgs() {
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getsupply - Report the total supply minted up to the current tip")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT - Send AMOUNT of coins from FROM address to TO")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT [-fee FEE] - Send AMOUNT of coins from FROM address to TO, paying FEE to the miner")
+	fmt.Println("  bumpfee -txid TXID -fee FEE - Replace the unconfirmed transaction TXID sent from the wallet with one paying FEE")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  startnode [-miner ADDRESS] [-threads THREADS] [-mintxs MIN] [-maxtxs MAX] [-blockmaxweight WEIGHT] [-blockorder ORDER]")
+	fmt.Println("      [-blockinterval SECONDS] [-rpcport PORT] [-maxinbound IN] [-maxoutbound OUT] - Start a node and mine with THREADS")
+	fmt.Println("      workers, sending rewards to ADDRESS. A block is started once MIN transactions are pending or SECONDS after the last")
+	fmt.Println("      block, with at most MAX transactions and WEIGHT weight picked by fee rate or arrival ORDER. JSON-RPC mining calls are")
+	fmt.Println("      served on localhost:PORT. At most IN peers may connect to the node and it connects to at most OUT peers")
+	fmt.Println("  migratedb - Rewrites a database created with the gob encoding in the canonical encoding and rebuilds its UTXO set")
 }
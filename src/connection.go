@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+const writeTimeout = 30 * time.Second
+
+// sendQueueLength is the number of messages waiting to be written to a connection before
+// the peer is considered too slow and disconnected
+const sendQueueLength = 256
+
+var errConnectionClosed = errors.New("the connection is closed")
+
+type message struct {
+	command string
+	payload []byte
+}
+
+// Connection is a long-lived connection to another node. A reader goroutine hands the
+// incoming messages to a handler and a writer goroutine sends the queued ones, so
+// requests and responses flow both ways over the same connection.
+type Connection struct {
+	// Addr is the listening address of the remote node. It is the dialed address for
+	// outbound connections and is learned from the version message for inbound ones.
+	Addr     string
+	Outbound bool
+	// Host is the IP address the connection comes from, which the remote node cannot choose
+	Host string
+
+	conn       net.Conn
+	queue      chan message
+	closed     chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{}
+}
+
+func newConnection(conn net.Conn, addr string, outbound bool) *Connection {
+	host := conn.RemoteAddr().String()
+	if ip, _, err := net.SplitHostPort(host); err == nil {
+		host = ip
+	}
+
+	return &Connection{
+		Addr:       addr,
+		Outbound:   outbound,
+		Host:       host,
+		conn:       conn,
+		queue:      make(chan message, sendQueueLength),
+		closed:     make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+}
+
+// Send queues a message. A peer that lets its queue fill up is disconnected.
+func (c *Connection) Send(command string, payload []byte) error {
+	select {
+	case <-c.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	select {
+	case c.queue <- message{command, payload}:
+		return nil
+	default:
+		c.Close()
+		return fmt.Errorf("the send queue of %s is full", c)
+	}
+}
+
+// Close closes the connection right away, dropping the messages still queued
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *Connection) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush waits until the queued messages are written and closes the connection
+func (c *Connection) flush() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		<-c.writerDone
+		_ = c.conn.Close()
+	})
+}
+
+func (c *Connection) String() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Connection) writeLoop() {
+	defer close(c.writerDone)
+
+	for {
+		select {
+		case msg := <-c.queue:
+			if !c.write(msg) {
+				return
+			}
+		case <-c.closed:
+			// send what was queued before the connection was flushed
+			for {
+				select {
+				case msg := <-c.queue:
+					if !c.write(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Connection) write(msg message) bool {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := writeMessage(c.conn, msg.command, msg.payload); err != nil {
+		select {
+		case <-c.closed:
+		default:
+			fmt.Printf("Could not send %s to %s: %s\n", msg.command, c, err)
+		}
+		c.Close()
+		return false
+	}
+
+	return true
+}
+
+func (c *Connection) readLoop(handle func(c *Connection, command string, payload []byte)) {
+	for {
+		command, payload, err := readMessage(c.conn)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				if err != io.EOF {
+					fmt.Printf("Disconnecting %s: %s\n", c, err)
+				}
+				c.Close()
+			}
+			return
+		}
+
+		handle(c, command, payload)
+	}
+}
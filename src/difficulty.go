@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"math/big"
+)
+
+// powLimit is the easiest target a block may have
+var powLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(1))
+
+// CompactToBig expands a target stored in the compact "bits" format used by Bitcoin:
+// the high byte is the size of the number in bytes and the low three bytes are its most
+// significant digits
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+
+	return target
+}
+
+// BigToCompact converts a target to the compact "bits" format, dropping the digits that do not fit
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Bits()[0])
+	}
+
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// targetBitsToCompact returns the compact target that requires the given number of leading zero bits
+func targetBitsToCompact(bits uint) uint32 {
+	return BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-bits))
+}
+
+// nextBits returns the difficulty a child of parent must carry. It only changes every
+// RetargetInterval blocks, scaling the target by how far the observed time of the last
+// interval was from the target block time.
+func nextBits(b *bolt.Bucket, parent *Block) uint32 {
+	height := parent.Height + 1
+	interval := chainParams.RetargetInterval
+
+	if height%interval != 0 {
+		return parent.Bits
+	}
+
+	first := getAncestor(b, parent, height-interval)
+	actualTimespan := parent.Timestamp - first.Timestamp
+	expectedTimespan, minTimespan, maxTimespan := retargetTimespans()
+
+	if actualTimespan < minTimespan {
+		actualTimespan = minTimespan
+	}
+	if actualTimespan > maxTimespan {
+		actualTimespan = maxTimespan
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actualTimespan))
+	target.Div(target, big.NewInt(expectedTimespan))
+
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+
+	return BigToCompact(target)
+}
+
+// retargetTimespans returns the time a retarget interval should take and the bounds the
+// observed time is clamped to, which scale the target by at most four either way. The
+// lower bound is at least a second, or short intervals could bring the target down to zero.
+func retargetTimespans() (int64, int64, int64) {
+	expected := int64(chainParams.RetargetInterval-1) * chainParams.TargetBlockTime
+
+	lowest := expected / 4
+	if lowest < 1 {
+		lowest = 1
+	}
+
+	return expected, lowest, expected * 4
+}
+
+// getAncestor walks back from the block to its ancestor at the given height
+func getAncestor(b *bolt.Bucket, block *Block, height int) *Block {
+	for block != nil && block.Height > height {
+		block = getBlock(b, []byte(block.PreviousHash))
+	}
+
+	return block
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// parentTarget is exactly representable in the compact format, as are four times and a
+// quarter of it
+var parentTarget = new(big.Int).Lsh(big.NewInt(1), 250)
+
+func setRetargetParams(t *testing.T, interval int, blockTime int64) {
+	params := chainParams
+	t.Cleanup(func() { chainParams = params })
+
+	chainParams.RetargetInterval = interval
+	chainParams.TargetBlockTime = blockTime
+}
+
+// retargetParent stores a chain of RetargetInterval blocks at the target with the given time
+// between the first and the last one and returns the last block, the parent of a retarget
+func retargetParent(t *testing.T, target *big.Int, timespan int64) (*bolt.DB, *Block) {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "blocks.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	address := string(NewWallet().GetAddress())
+	var parent *Block
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+
+		var prevHash []byte
+		for height := 0; height < chainParams.RetargetInterval; height++ {
+			coinbase := NewCoinbaseTX(address, "", height, 0)
+			parent = newUnminedBlock([]*Transaction{coinbase}, prevHash, height, BigToCompact(target))
+			parent.Timestamp = 1000
+			if height == chainParams.RetargetInterval-1 {
+				parent.Timestamp += timespan
+			}
+			parent.Hash = string(parent.BlockHeader.Hash())
+			prevHash = []byte(parent.Hash)
+
+			if err := b.Put(prevHash, parent.Serialize()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, parent
+}
+
+func runNextBits(t *testing.T, db *bolt.DB, parent *Block) *big.Int {
+	t.Helper()
+
+	var bits uint32
+	err := db.View(func(tx *bolt.Tx) error {
+		bits = nextBits(tx.Bucket([]byte(blocksBucket)), parent)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return CompactToBig(bits)
+}
+
+func scaledTarget(num, denom int64) *big.Int {
+	target := new(big.Int).Mul(parentTarget, big.NewInt(num))
+
+	return target.Div(target, big.NewInt(denom))
+}
+
+func TestNextBits(t *testing.T) {
+	setRetargetParams(t, 5, 10)
+	expected := int64(4 * 10)
+
+	tests := []struct {
+		name     string
+		timespan int64
+		want     *big.Int
+	}{
+		{"on time", expected, parentTarget},
+		{"twice as slow", 2 * expected, scaledTarget(2, 1)},
+		{"twice as fast", expected / 2, scaledTarget(1, 2)},
+		{"clamped fast", 0, scaledTarget(1, 4)},
+		{"clamped slow", 100 * expected, scaledTarget(4, 1)},
+	}
+
+	for _, test := range tests {
+		db, parent := retargetParent(t, parentTarget, test.timespan)
+		if got := runNextBits(t, db, parent); got.Cmp(test.want) != 0 {
+			t.Errorf("%s: target %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNextBitsBetweenRetargets(t *testing.T) {
+	setRetargetParams(t, 5, 10)
+	db, parent := retargetParent(t, parentTarget, 0)
+	parent.Height++
+
+	if got := runNextBits(t, db, parent); got.Cmp(parentTarget) != 0 {
+		t.Errorf("target %x, want the parent's %x", got, parentTarget)
+	}
+}
+
+func TestNextBitsCappedAtPowLimit(t *testing.T) {
+	setRetargetParams(t, 5, 10)
+	db, parent := retargetParent(t, new(big.Int).Rsh(powLimit, 1), 1000)
+	if got := runNextBits(t, db, parent); got.Cmp(powLimit) > 0 {
+		t.Errorf("target %x is above the proof of work limit", got)
+	}
+}
+
+func TestNextBitsShortRetargetInterval(t *testing.T) {
+	// an expected timespan of one second used to clamp the observed one to zero
+	setRetargetParams(t, 2, 1)
+
+	db, parent := retargetParent(t, parentTarget, 0)
+	if got := runNextBits(t, db, parent); got.Sign() <= 0 {
+		t.Errorf("target %x is not positive", got)
+	}
+}
+
+// mineHeader finds a nonce for a header following parent
+func mineHeader(parent *headerNode, target *big.Int) (BlockHeader, string) {
+	header := BlockHeader{
+		Version:      blockVersion,
+		PreviousHash: parent.Hash,
+		Timestamp:    time.Now().Unix(),
+		Bits:         BigToCompact(target),
+	}
+	for ; ; header.Nonce++ {
+		block := &Block{BlockHeader: header}
+		if NewProofOfWork(block).Validate() {
+			return header, string(header.Hash())
+		}
+	}
+}
+
+func TestCheckHeaderDifficultyBounds(t *testing.T) {
+	setRetargetParams(t, 5, 10)
+	parent := &headerNode{
+		Header: BlockHeader{Bits: BigToCompact(parentTarget)},
+		Hash:   string(make([]byte, hashLength)),
+		Height: 3,
+	}
+
+	tests := []struct {
+		name     string
+		height   int
+		target   *big.Int
+		accepted bool
+	}{
+		{"same bits", 3, parentTarget, true},
+		{"changed bits", 3, scaledTarget(1, 2), false},
+		{"retarget down to a quarter", 4, scaledTarget(1, 4), true},
+		{"retarget below a quarter", 4, scaledTarget(1, 5), false},
+		{"retarget up to four times", 4, scaledTarget(4, 1), true},
+		{"retarget above four times", 4, scaledTarget(5, 1), false},
+	}
+
+	for _, test := range tests {
+		parent.Height = test.height
+		header, hash := mineHeader(parent, test.target)
+		err := checkHeader(header, hash, parent)
+		if accepted := err == nil; accepted != test.accepted {
+			t.Errorf("%s: got %v, want accepted %t", test.name, err, test.accepted)
+		}
+	}
+}
+
+func TestCheckHeaderShortRetargetInterval(t *testing.T) {
+	// the clamped timespan cannot go below a second, so the target cannot drop at all
+	setRetargetParams(t, 2, 1)
+	parent := &headerNode{
+		Header: BlockHeader{Bits: BigToCompact(parentTarget)},
+		Hash:   string(make([]byte, hashLength)),
+		Height: 1,
+	}
+
+	header, hash := mineHeader(parent, scaledTarget(1, 2))
+	if err := checkHeader(header, hash, parent); err == nil {
+		t.Error("a header with half the target of its parent was accepted")
+	}
+	header, hash = mineHeader(parent, parentTarget)
+	if err := checkHeader(header, hash, parent); err != nil {
+		t.Error(err)
+	}
+}
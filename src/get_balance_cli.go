@@ -13,14 +13,12 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 	UTXOSet := UTXOSet{bc}
 	defer bc.DB.Close()
 
-	balance := 0
 	pubKeyHash := Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance, immature := UTXOSet.FindBalance(pubKeyHash)
 
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature mining rewards: %d\n", immature)
+	}
 }
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+func (cli *CLI) getSupply(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.DB.Close()
+
+	height := bc.GetBestHeight()
+	supply := UTXOSet.TotalValue()
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Supply in the UTXO set: %d\n", supply)
+	fmt.Printf("Minted by the subsidy schedule: %d\n", totalSubsidy(height))
+	fmt.Printf("Next block subsidy: %d\n", blockSubsidy(height+1))
+	fmt.Printf("Maximum supply: %d\n", maxSupply())
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+// maxHeadersPerMessage bounds a headers message. A full message means the peer has more.
+const maxHeadersPerMessage = 2000
+
+// maxLocatorLength bounds the hashes of a getheaders locator, which only grows with the
+// logarithm of the chain height
+const maxLocatorLength = 101
+
+type headerNode struct {
+	Header BlockHeader
+	Hash   string
+	Height int
+	// Work is the cumulative work of the chain ending with the header
+	Work *big.Int
+}
+
+// HeaderChain keeps the headers received from peers ahead of their blocks. Headers are
+// checked for proof of work and linked to a known parent when they arrive, so the branch
+// with the most work is known before any of its blocks is downloaded. Headers of stored
+// blocks are looked up in the chain.
+type HeaderChain struct {
+	bc *Blockchain
+
+	mutex   sync.Mutex
+	nodes   map[string]*headerNode
+	invalid map[string]bool
+	best    *headerNode
+}
+
+func NewHeaderChain(bc *Blockchain) *HeaderChain {
+	return &HeaderChain{
+		bc:      bc,
+		nodes:   make(map[string]*headerNode),
+		invalid: make(map[string]bool),
+	}
+}
+
+// Add links headers received from a peer to the header tree and returns the node of the
+// last one. Headers already known are skipped. It stops at the first header that does not
+// connect or fails the checks, with a *BlockValidationError.
+func (hc *HeaderChain) Add(headers []BlockHeader) (*headerNode, error) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	var last *headerNode
+	for _, header := range headers {
+		hash := string(headerHash(header))
+		if hc.invalid[hash] {
+			return last, rejectBlock(RejectBadParent, "header %x is of an invalid block", hash)
+		}
+		if node := hc.lookup(hash); node != nil {
+			last = node
+			continue
+		}
+
+		parent := hc.lookup(header.PreviousHash)
+		if parent == nil {
+			if hc.invalid[header.PreviousHash] {
+				return last, rejectBlock(RejectBadParent, "header %x descends from an invalid block", hash)
+			}
+			return last, rejectBlock(RejectUnknownParent, "parent %x of header %x is not known", header.PreviousHash, hash)
+		}
+		if err := checkHeader(header, hash, parent); err != nil {
+			return last, err
+		}
+
+		work := NewProofOfWork(&Block{BlockHeader: header}).Work()
+		node := &headerNode{header, hash, parent.Height + 1, work.Add(work, parent.Work)}
+		hc.nodes[hash] = node
+		if hc.best == nil || node.Work.Cmp(hc.best.Work) > 0 {
+			hc.best = node
+		}
+		last = node
+	}
+
+	return last, nil
+}
+
+// Best returns the header with the most cumulative work, the chain tip unless peers
+// announced a better branch
+func (hc *HeaderChain) Best() *headerNode {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	tip := hc.lookup(string(hc.bc.TipHash()))
+	if hc.best != nil && hc.best.Work.Cmp(tip.Work) > 0 {
+		return hc.best
+	}
+
+	return tip
+}
+
+// Missing returns the headers from the given one back to the first ancestor whose block
+// is stored, parents first
+func (hc *HeaderChain) Missing(hash string) []*headerNode {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	var missing []*headerNode
+	for node := hc.nodes[hash]; node != nil && !hc.bc.HasBlock([]byte(node.Hash)); node = hc.nodes[node.Header.PreviousHash] {
+		missing = append(missing, node)
+	}
+
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+
+	return missing
+}
+
+// Locator lists hashes going back from the header, one by one at first and then doubling
+// the step down to the genesis block, so a peer can find where its chain forks off
+func (hc *HeaderChain) Locator(hash string) [][]byte {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	var locator [][]byte
+	step := 1
+
+	for node := hc.lookup(hash); node != nil; {
+		locator = append(locator, []byte(node.Hash))
+		if node.Height == 0 {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+
+		height := node.Height - step
+		if height < 0 {
+			height = 0
+		}
+		for node != nil && node.Height > height {
+			node = hc.lookup(node.Header.PreviousHash)
+		}
+	}
+
+	return locator
+}
+
+// Invalidate drops the header of a block that failed validation and the headers built on
+// it. They are refused from then on.
+func (hc *HeaderChain) Invalidate(hash string) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	hc.invalid[hash] = true
+
+	var descendants []string
+	for id, node := range hc.nodes {
+		for ; node != nil; node = hc.nodes[node.Header.PreviousHash] {
+			if node.Hash == hash {
+				descendants = append(descendants, id)
+				break
+			}
+		}
+	}
+	for _, id := range descendants {
+		hc.invalid[id] = true
+		delete(hc.nodes, id)
+	}
+
+	hc.best = nil
+	for _, node := range hc.nodes {
+		if hc.best == nil || node.Work.Cmp(hc.best.Work) > 0 {
+			hc.best = node
+		}
+	}
+}
+
+// lookup returns the node of a received header or of a stored block, the mutex must be held
+func (hc *HeaderChain) lookup(hash string) *headerNode {
+	if node, ok := hc.nodes[hash]; ok {
+		return node
+	}
+	if len(hash) == 0 {
+		return nil
+	}
+
+	block, err := hc.bc.GetBlock([]byte(hash))
+	if err != nil {
+		return nil
+	}
+	work := hc.bc.GetChainWork([]byte(hash))
+	if work == nil {
+		return nil
+	}
+
+	return &headerNode{block.BlockHeader, hash, block.Height, work}
+}
+
+func headerHash(header BlockHeader) []byte {
+	return NewProofOfWork(&Block{BlockHeader: header}).Hash()
+}
+
+// checkHeader runs the checks a header allows without its block and the ancestors of its
+// parent: the proof of work, a difficulty the parent's may have been adjusted to and the
+// timestamp. The block is fully validated when it is added.
+func checkHeader(header BlockHeader, hash string, parent *headerNode) error {
+	if err := checkProofOfWork(&Block{BlockHeader: header, Hash: hash}); err != nil {
+		return err
+	}
+
+	if (parent.Height+1)%chainParams.RetargetInterval != 0 {
+		if header.Bits != parent.Header.Bits {
+			return rejectBlock(RejectBadDifficulty, "bits %08x, expected %08x", header.Bits, parent.Header.Bits)
+		}
+	} else {
+		// the bounds nextBits clamps the observed timespan to
+		expectedTimespan, minTimespan, maxTimespan := retargetTimespans()
+		parentTarget := CompactToBig(parent.Header.Bits)
+
+		lowest := new(big.Int).Mul(parentTarget, big.NewInt(minTimespan))
+		lowest = CompactToBig(BigToCompact(lowest.Div(lowest, big.NewInt(expectedTimespan))))
+		highest := new(big.Int).Mul(parentTarget, big.NewInt(maxTimespan))
+		highest.Div(highest, big.NewInt(expectedTimespan))
+
+		if target := CompactToBig(header.Bits); target.Cmp(lowest) < 0 || target.Cmp(highest) > 0 {
+			return rejectBlock(RejectBadDifficulty, "bits %08x are out of the adjustment range of %08x", header.Bits, parent.Header.Bits)
+		}
+	}
+
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is too far in the future", header.Timestamp)
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"log"
+	"strconv"
+)
+
+// Blocks and transactions created before the canonical encoding are version 0. They were
+// stored and hashed with gob, so their IDs, Merkle roots and block hashes can only be
+// recomputed from the gob encoding of the structures of that time.
+const legacyVersion = 0
+
+// Blocks of the first layout have no Bits field. They were all mined at this fixed target.
+const baselineTargetBits = 24
+
+type legacyTXInput struct {
+	TxID      string
+	Vout      int
+	Signature []byte
+	PubKey    []byte
+}
+
+type legacyTXOutput struct {
+	Value      int
+	PubKeyHash []byte
+}
+
+type legacyTransaction struct {
+	ID   string
+	Vin  []legacyTXInput
+	Vout []legacyTXOutput
+}
+
+type legacyBlock struct {
+	Transactions []*legacyTransaction
+	Timestamp    string
+	Hash         string
+	PreviousHash string
+	Nonce        int
+	Height       int
+	Bits         uint32
+}
+
+// encodeLegacyTransaction returns the gob encoding a version 0 transaction was hashed with
+var encodeLegacyTransaction func(tx legacyTransaction) []byte
+
+// gob writes type names, field names and type numbers into its output, and numbers types
+// in the order a process first encodes them. The types below carry the names the encoded
+// structures had, and encoding an empty block of them first gives them the numbers
+// they always had.
+func init() {
+	type TXInput legacyTXInput
+	type TXOutput legacyTXOutput
+	type Transaction struct {
+		ID   string
+		Vin  []TXInput
+		Vout []TXOutput
+	}
+	type Block struct {
+		Transactions []*Transaction
+		Timestamp    string
+		Hash         string
+		PreviousHash string
+		Nonce        int
+		Height       int
+		Bits         uint32
+	}
+
+	err := gob.NewEncoder(ioutil.Discard).Encode(Block{})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	encodeLegacyTransaction = func(tx legacyTransaction) []byte {
+		encodable := Transaction{ID: tx.ID}
+		for _, vin := range tx.Vin {
+			encodable.Vin = append(encodable.Vin, TXInput(vin))
+		}
+		for _, vout := range tx.Vout {
+			encodable.Vout = append(encodable.Vout, TXOutput(vout))
+		}
+
+		var encoded bytes.Buffer
+		err := gob.NewEncoder(&encoded).Encode(encodable)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return encoded.Bytes()
+	}
+}
+
+// legacySerialize returns the gob encoding of a version 0 transaction, ID included
+func (tx *Transaction) legacySerialize() []byte {
+	legacy := legacyTransaction{ID: tx.ID}
+	for _, vin := range tx.Vin {
+		legacy.Vin = append(legacy.Vin, legacyTXInput(vin))
+	}
+	for _, vout := range tx.Vout {
+		legacy.Vout = append(legacy.Vout, legacyTXOutput(vout))
+	}
+
+	return encodeLegacyTransaction(legacy)
+}
+
+func (tx legacyTransaction) upgrade() *Transaction {
+	transaction := &Transaction{ID: tx.ID, version: legacyVersion}
+	for _, vin := range tx.Vin {
+		transaction.Vin = append(transaction.Vin, TXInput(vin))
+	}
+	for _, vout := range tx.Vout {
+		transaction.Vout = append(transaction.Vout, TXOutput(vout))
+	}
+
+	return transaction
+}
+
+func decodeLegacyTransaction(data []byte) (*Transaction, error) {
+	var tx legacyTransaction
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.upgrade(), tx.checkHashes()
+}
+
+// checkLegacyHash makes sure a hash fits the fixed-width hash fields of the canonical encoding
+func checkLegacyHash(hash string) error {
+	if len(hash) != 0 && len(hash) != hashLength {
+		return fmt.Errorf("hash %x is not %d bytes long", hash, hashLength)
+	}
+
+	return nil
+}
+
+func (tx legacyTransaction) checkHashes() error {
+	for _, vin := range tx.Vin {
+		if err := checkLegacyHash(vin.TxID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeLegacyBlock(data []byte) (*Block, error) {
+	var legacy legacyBlock
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := strconv.ParseInt(legacy.Timestamp, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if legacy.Bits == 0 {
+		legacy.Bits = targetBitsToCompact(baselineTargetBits)
+	}
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:      legacyVersion,
+			PreviousHash: legacy.PreviousHash,
+			Timestamp:    timestamp,
+			Bits:         legacy.Bits,
+			Nonce:        legacy.Nonce,
+		},
+		Hash:   legacy.Hash,
+		Height: legacy.Height,
+	}
+	if err := checkLegacyHash(legacy.Hash); err != nil {
+		return nil, err
+	}
+	if err := checkLegacyHash(legacy.PreviousHash); err != nil {
+		return nil, err
+	}
+	for _, tx := range legacy.Transactions {
+		if err := tx.checkHashes(); err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, tx.upgrade())
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	return block, nil
+}
+
+func decodeLegacyBlockUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+
+	return undo, err
+}
+
+// hasLegacyValues reports whether any value of the bucket is gob-encoded
+func hasLegacyValues(b *bolt.Bucket) bool {
+	legacy := false
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil && !legacy; k, v = c.Next() {
+		legacy = !isCanonical(v)
+	}
+
+	return legacy
+}
+
+// migrateBucket rewrites the gob-encoded values of a bucket in the canonical encoding.
+// Keys for which skip returns true are left alone.
+func migrateBucket(b *bolt.Bucket, skip func(key []byte) bool, reencode func(value []byte) ([]byte, error)) (int, error) {
+	legacy := make(map[string][]byte)
+
+	err := b.ForEach(func(k, v []byte) error {
+		if !skip(k) && !isCanonical(v) {
+			legacy[string(k)] = v
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for key, value := range legacy {
+		encoded, err := reencode(value)
+		if err != nil {
+			return 0, fmt.Errorf("%x: %s", key, err)
+		}
+		if err := b.Put([]byte(key), encoded); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacy), nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMempoolSize bounds the serialized size of the pooled transactions in bytes
+const maxMempoolSize = 5 * 1024 * 1024
+const mempoolExpiry = 24 * time.Hour
+
+// maxReplacements caps the pooled transactions a replacement may evict, descendants included
+const maxReplacements = 100
+
+var errMempoolFull = errors.New("the mempool is full and the transaction pays too little")
+var errMissingParent = errors.New("the transaction of the output is unknown")
+
+// MissingParentsError rejects a transaction spending outputs of transactions that are
+// neither pooled nor in the UTXO set, usually because its parents have not arrived yet
+type MissingParentsError struct {
+	Parents []string
+}
+
+func (e *MissingParentsError) Error() string {
+	return fmt.Sprintf("%d parent transactions are missing", len(e.Parents))
+}
+
+// Outpoint identifies a transaction output
+type Outpoint struct {
+	TxID  string
+	Index int
+}
+
+type mempoolEntry struct {
+	Tx     *Transaction
+	Fee    int
+	Size   int
+	Weight int
+	Added  time.Time
+
+	sequence uint64
+}
+
+// paysLessThan compares fee rates, the fee per byte of serialized transaction
+func (e *mempoolEntry) paysLessThan(other *mempoolEntry) bool {
+	return e.Fee*other.Size < other.Fee*e.Size
+}
+
+// Mempool holds the valid transactions waiting to be mined. A transaction may spend
+// outputs of the UTXO set and of other pooled transactions, but no two pooled transactions
+// spend the same output. A conflicting transaction replaces the pooled ones when it pays
+// more.
+type Mempool struct {
+	mutex    sync.RWMutex
+	entries  map[string]*mempoolEntry
+	spends   map[Outpoint]string
+	size     int
+	maxSize  int
+	expiry   time.Duration
+	sequence uint64
+}
+
+func NewMempool(maxSize int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		entries: make(map[string]*mempoolEntry),
+		spends:  make(map[Outpoint]string),
+		maxSize: maxSize,
+		expiry:  expiry,
+	}
+}
+
+// Add validates the transaction against the chain tip and the pool and adds it. A
+// transaction spending outputs already spent in the pool replaces the conflicting
+// transactions and their descendants if it pays a higher fee than all of them together and
+// a higher fee rate than each. When the pool grows over its size limit the transactions
+// paying the lowest fee rate are evicted.
+func (mp *Mempool) Add(tx *Transaction, bc *Blockchain) error {
+	return mp.add(tx, bc, time.Now())
+}
+
+func (mp *Mempool) add(tx *Transaction, bc *Blockchain, added time.Time) error {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.expire(time.Now())
+
+	if tx.IsCoinbase() {
+		return errors.New("coinbase transactions are only valid in blocks")
+	}
+	if !bytes.Equal([]byte(tx.ID), tx.Hash()) {
+		return errors.New("the transaction does not match its ID")
+	}
+	if err := checkTransaction(tx); err != nil {
+		return err
+	}
+	if _, ok := mp.entries[tx.ID]; ok {
+		return errors.New("the transaction is already in the mempool")
+	}
+
+	replaced := mp.conflicts(tx)
+	if len(replaced) > maxReplacements {
+		return fmt.Errorf("the transaction would replace %d transactions, more than %d", len(replaced), maxReplacements)
+	}
+	for _, vin := range tx.Vin {
+		if _, ok := replaced[vin.TxID]; ok {
+			return fmt.Errorf("the transaction spends %x, which it replaces", vin.TxID)
+		}
+	}
+
+	fee, err := mp.checkInputs(tx, bc, true)
+	if err != nil {
+		return err
+	}
+
+	entry := &mempoolEntry{tx, fee, len(tx.Serialize()), transactionWeight(tx), added, 0}
+	if err := checkReplacement(entry, replaced); err != nil {
+		return err
+	}
+
+	for id := range replaced {
+		mp.remove(id)
+	}
+	if len(replaced) > 0 {
+		fmt.Printf("Transaction %x replaced %d transactions\n", tx.ID, len(replaced))
+	}
+
+	mp.insert(entry)
+	mp.evict()
+
+	if _, ok := mp.entries[tx.ID]; !ok {
+		return errMempoolFull
+	}
+
+	return nil
+}
+
+// Readmit adds back the transactions of disconnected blocks, parents before children
+func (mp *Mempool) Readmit(txs []*Transaction, bc *Blockchain) {
+	for _, tx := range txs {
+		if err := mp.Add(tx, bc); err != nil {
+			fmt.Printf("Dropped transaction %x: %s\n", tx.ID, err)
+		}
+	}
+}
+
+// RemoveForBlock removes the transactions confirmed by the block, along with the pooled
+// transactions that spend the same outputs and their descendants
+func (mp *Mempool) RemoveForBlock(block *Block) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	for _, tx := range block.Transactions {
+		if _, ok := mp.entries[tx.ID]; ok {
+			mp.remove(tx.ID)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		for _, vin := range tx.Vin {
+			if spender, ok := mp.spends[Outpoint{vin.TxID, vin.Vout}]; ok {
+				mp.removeWithDescendants(spender)
+			}
+		}
+	}
+}
+
+// Revalidate drops the transactions a new tip made invalid, for instance by a reorg that
+// disconnected their inputs or made a coinbase immature again, and the expired ones
+func (mp *Mempool) Revalidate(bc *Blockchain) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.expire(time.Now())
+
+	for _, entry := range mp.sortedEntries() {
+		if _, ok := mp.entries[entry.Tx.ID]; !ok {
+			continue
+		}
+		if _, err := mp.checkInputs(entry.Tx, bc, false); err != nil {
+			fmt.Printf("Dropped transaction %x: %s\n", entry.Tx.ID, err)
+			mp.removeWithDescendants(entry.Tx.ID)
+		}
+	}
+}
+
+// RemoveRejected drops the pooled transactions of a block the chain rejected that fail the
+// checks again, along with their descendants. The ones that pass stay in the pool.
+func (mp *Mempool) RemoveRejected(txs []*Transaction, bc *Blockchain) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	var invalid []string
+	for _, tx := range txs {
+		if _, ok := mp.entries[tx.ID]; !ok {
+			continue
+		}
+
+		err := checkTransaction(tx)
+		if err == nil {
+			_, err = mp.checkInputs(tx, bc, true)
+		}
+		if err != nil {
+			fmt.Printf("Dropped transaction %x: %s\n", tx.ID, err)
+			invalid = append(invalid, tx.ID)
+		}
+	}
+	for _, id := range invalid {
+		mp.removeWithDescendants(id)
+	}
+}
+
+func (mp *Mempool) Get(id string) (*Transaction, bool) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	entry, ok := mp.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	return entry.Tx, true
+}
+
+func (mp *Mempool) Has(id string) bool {
+	_, ok := mp.Get(id)
+
+	return ok
+}
+
+// Fee returns the fee paid by a pooled transaction
+func (mp *Mempool) Fee(id string) int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	if entry, ok := mp.entries[id]; ok {
+		return entry.Fee
+	}
+
+	return 0
+}
+
+func (mp *Mempool) Count() int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return len(mp.entries)
+}
+
+// Transactions returns the pooled transactions in the order they were added, which puts
+// parents before their children
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var txs []*Transaction
+	for _, entry := range mp.sortedEntries() {
+		txs = append(txs, entry.Tx)
+	}
+
+	return txs
+}
+
+// snapshot returns copies of the pooled entries in the order they were added
+func (mp *Mempool) snapshot() []mempoolEntry {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var entries []mempoolEntry
+	for _, entry := range mp.sortedEntries() {
+		entries = append(entries, *entry)
+	}
+
+	return entries
+}
+
+func (mp *Mempool) sortedEntries() []*mempoolEntry {
+	var entries []*mempoolEntry
+	for _, entry := range mp.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].sequence < entries[j].sequence })
+
+	return entries
+}
+
+// checkInputs finds the outputs spent by the transaction in the pool or the UTXO set and
+// returns the fee. Inputs of unknown transactions are reported together in a
+// MissingParentsError. Signatures do not depend on the chain state and can be skipped when
+// the transaction was checked before.
+func (mp *Mempool) checkInputs(tx *Transaction, bc *Blockchain, verifySignatures bool) (int, error) {
+	var prevOuts []TXOutput
+	var missing []string
+	missingSet := make(map[string]bool)
+	inValue := 0
+	height := bc.GetBestHeight() + 1
+
+	err := bc.DB.View(func(dbTx *bolt.Tx) error {
+		utxo := dbTx.Bucket([]byte(utxoBucket))
+
+		for _, vin := range tx.Vin {
+			out, err := mp.findOutput(utxo, vin, height)
+			if err == errMissingParent {
+				if !missingSet[vin.TxID] {
+					missingSet[vin.TxID] = true
+					missing = append(missing, vin.TxID)
+				}
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			prevOuts = append(prevOuts, out)
+			inValue += out.Value
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(missing) > 0 {
+		return 0, &MissingParentsError{missing}
+	}
+
+	outValue := 0
+	for _, out := range tx.Vout {
+		outValue += out.Value
+	}
+	if outValue > inValue {
+		return 0, errors.New("the transaction spends more than its inputs")
+	}
+
+	if verifySignatures && !tx.VerifyInputs(prevOuts) {
+		return 0, errors.New("the transaction has an invalid signature")
+	}
+
+	return inValue - outValue, nil
+}
+
+func (mp *Mempool) findOutput(utxo *bolt.Bucket, vin TXInput, height int) (TXOutput, error) {
+	if parent, ok := mp.entries[vin.TxID]; ok {
+		if vin.Vout < 0 || vin.Vout >= len(parent.Tx.Vout) {
+			return TXOutput{}, fmt.Errorf("output %x:%d does not exist", vin.TxID, vin.Vout)
+		}
+
+		return parent.Tx.Vout[vin.Vout], nil
+	}
+
+	// without a transaction index an unknown parent and a fully spent one look the same
+	outsBytes := utxo.Get([]byte(vin.TxID))
+	if outsBytes == nil {
+		return TXOutput{}, errMissingParent
+	}
+
+	outs := DeserializeOutputs(outsBytes)
+	out, ok := outs.Outputs[vin.Vout]
+	if !ok {
+		return TXOutput{}, fmt.Errorf("output %x:%d is not unspent", vin.TxID, vin.Vout)
+	}
+	if !outs.IsMature(height) {
+		return TXOutput{}, fmt.Errorf("output %x:%d is an immature coinbase", vin.TxID, vin.Vout)
+	}
+
+	return out, nil
+}
+
+// conflicts returns the pooled transactions spending an output the transaction spends and
+// all their descendants
+func (mp *Mempool) conflicts(tx *Transaction) map[string]*mempoolEntry {
+	replaced := make(map[string]*mempoolEntry)
+
+	var collect func(id string)
+	collect = func(id string) {
+		if _, ok := replaced[id]; ok {
+			return
+		}
+		entry := mp.entries[id]
+		replaced[id] = entry
+
+		for outIdx := range entry.Tx.Vout {
+			if spender, ok := mp.spends[Outpoint{id, outIdx}]; ok {
+				collect(spender)
+			}
+		}
+	}
+
+	for _, vin := range tx.Vin {
+		if spender, ok := mp.spends[Outpoint{vin.TxID, vin.Vout}]; ok {
+			collect(spender)
+		}
+	}
+
+	return replaced
+}
+
+// checkReplacement accepts a replacement paying more than the transactions it evicts
+// together, so that replacing cannot lower the fees a miner collects, and a higher fee rate
+// than each of them
+func checkReplacement(entry *mempoolEntry, replaced map[string]*mempoolEntry) error {
+	replacedFees := 0
+	for _, old := range replaced {
+		if !old.paysLessThan(entry) {
+			return fmt.Errorf("the replacement pays a lower fee rate than %x", old.Tx.ID)
+		}
+		replacedFees += old.Fee
+	}
+
+	if len(replaced) > 0 && entry.Fee <= replacedFees {
+		return fmt.Errorf("the replacement pays a fee of %d, not more than the %d of the transactions it replaces", entry.Fee, replacedFees)
+	}
+
+	return nil
+}
+
+func (mp *Mempool) insert(entry *mempoolEntry) {
+	mp.sequence++
+	entry.sequence = mp.sequence
+
+	mp.entries[entry.Tx.ID] = entry
+	for _, vin := range entry.Tx.Vin {
+		mp.spends[Outpoint{vin.TxID, vin.Vout}] = entry.Tx.ID
+	}
+	mp.size += entry.Size
+}
+
+// remove takes a transaction out of the pool, leaving its descendants
+func (mp *Mempool) remove(id string) {
+	entry := mp.entries[id]
+
+	for _, vin := range entry.Tx.Vin {
+		delete(mp.spends, Outpoint{vin.TxID, vin.Vout})
+	}
+	delete(mp.entries, id)
+	mp.size -= entry.Size
+}
+
+// removeWithDescendants removes a transaction and every pooled transaction depending on it
+func (mp *Mempool) removeWithDescendants(id string) {
+	entry, ok := mp.entries[id]
+	if !ok {
+		return
+	}
+
+	for outIdx := range entry.Tx.Vout {
+		if spender, ok := mp.spends[Outpoint{id, outIdx}]; ok {
+			mp.removeWithDescendants(spender)
+		}
+	}
+	mp.remove(id)
+}
+
+// evict removes the transactions with the lowest fee rate until the pool fits its limit
+func (mp *Mempool) evict() {
+	for mp.size > mp.maxSize {
+		var lowest *mempoolEntry
+		for _, entry := range mp.entries {
+			if lowest == nil || entry.paysLessThan(lowest) {
+				lowest = entry
+			}
+		}
+
+		mp.removeWithDescendants(lowest.Tx.ID)
+	}
+}
+
+func (mp *Mempool) expire(now time.Time) {
+	for id, entry := range mp.entries {
+		if now.Sub(entry.Added) > mp.expiry {
+			mp.removeWithDescendants(id)
+		}
+	}
+}
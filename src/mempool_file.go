@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const mempoolFile = "mempool_%s.dat"
+const mempoolFileVersion = 1
+
+// Save writes the pooled transactions to a file, parents before children, along with the
+// time each one was added
+func (mp *Mempool) Save(path string) error {
+	mp.mutex.RLock()
+	entries := mp.sortedEntries()
+	mp.mutex.RUnlock()
+
+	w := newBinaryWriter(mempoolFileVersion)
+	w.writeUvarint(uint64(len(entries)))
+	for _, entry := range entries {
+		w.writeVarint(entry.Added.Unix())
+		w.writeUvarint(uint64(entry.Tx.version))
+		entry.Tx.write(w)
+	}
+
+	// a crash while writing must not leave a truncated file behind
+	tmpPath := path + ".new"
+	if err := ioutil.WriteFile(tmpPath, w.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Load adds back the transactions saved by Save. Each one is validated again against the
+// current UTXO set, so the ones mined or invalidated in the meantime are dropped, as are
+// the expired ones. It returns the number of transactions added.
+func (mp *Mempool) Load(path string, bc *Blockchain) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	r, version := newBinaryReader(data)
+	if r.err == nil && version != mempoolFileVersion {
+		return 0, fmt.Errorf("unsupported mempool file version %d", version)
+	}
+
+	var txs []*Transaction
+	var added []time.Time
+	for i, n := 0, r.readCount(3); i < n; i++ {
+		added = append(added, time.Unix(r.readVarint(), 0))
+		txVersion := int(r.readUvarint())
+		txs = append(txs, readTransaction(r, txVersion))
+	}
+	if err := r.finish(); err != nil {
+		return 0, err
+	}
+
+	loaded := 0
+	for i, tx := range txs {
+		if time.Since(added[i]) > mp.expiry {
+			continue
+		}
+		if err := mp.add(tx, bc, added[i]); err != nil {
+			fmt.Printf("Dropped saved transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+		loaded++
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChain creates a blockchain in a temporary directory with an easy target and no
+// coinbase maturity, paying the genesis reward to a new wallet
+func testChain(t *testing.T) (*Blockchain, *Wallet) {
+	t.Helper()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	params := chainParams
+	chainParams.InitialTargetBits = 8
+	chainParams.CoinbaseMaturity = 0
+
+	wallet := NewWallet()
+	bc := CreateBlockchain(string(wallet.GetAddress()), "test")
+	t.Cleanup(func() {
+		_ = bc.DB.Close()
+		chainParams = params
+		_ = os.Chdir(dir)
+	})
+
+	return bc, wallet
+}
+
+// testMine mines a block with the transactions on top of the tip, paying the reward to
+// the wallet
+func testMine(t *testing.T, bc *Blockchain, wallet *Wallet, txs ...*Transaction) *Block {
+	t.Helper()
+
+	block, err := bc.MineBlock(context.Background(), string(wallet.GetAddress()), txs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// testSpend returns a transaction spending an output of prev, owned by the wallet, to
+// outputs of the given values locked to the wallet
+func testSpend(wallet *Wallet, prev *Transaction, vout int, values ...int) *Transaction {
+	tx := &Transaction{"", []TXInput{{prev.ID, vout, nil, wallet.PublicKey}}, nil, transactionVersion}
+	for _, value := range values {
+		tx.Vout = append(tx.Vout, *NewTXOutput(value, string(wallet.GetAddress())))
+	}
+	tx.Sign(wallet.PrivateKey, map[string]Transaction{prev.ID: *prev})
+	tx.ID = string(tx.Hash())
+
+	return tx
+}
+
+func addAll(t *testing.T, mp *Mempool, bc *Blockchain, txs ...*Transaction) {
+	t.Helper()
+
+	for _, tx := range txs {
+		if err := mp.Add(tx, bc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	bc, wallet := testChain(t)
+	coinbase := testMine(t, bc, wallet).Transactions[0]
+	value := coinbase.Vout[0].Value
+
+	// the parent pays a fee of 1 and its child 5
+	parent := testSpend(wallet, coinbase, 0, value-1)
+	child := testSpend(wallet, parent, 0, value-6)
+
+	tests := []struct {
+		name        string
+		replacement *Transaction
+		err         string
+	}{
+		{"lower fee", testSpend(wallet, coinbase, 0, value-5), "fee rate"},
+		{"same fee", testSpend(wallet, coinbase, 0, value-6), "not more than"},
+		{"higher fee at a lower rate", testSpend(wallet, coinbase, 0, append([]int{value - 7}, make([]int, 30)...)...), "fee rate"},
+	}
+
+	for _, test := range tests {
+		mp := NewMempool(maxMempoolSize, time.Hour)
+		addAll(t, mp, bc, parent, child)
+
+		err := mp.Add(test.replacement, bc)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.err)
+		}
+		if mp.Count() != 2 {
+			t.Errorf("%s: %d transactions are pooled, want the 2 it did not replace", test.name, mp.Count())
+		}
+	}
+
+	mp := NewMempool(maxMempoolSize, time.Hour)
+	addAll(t, mp, bc, parent, child)
+	replacement := testSpend(wallet, coinbase, 0, value-7)
+	if err := mp.Add(replacement, bc); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Count() != 1 || !mp.Has(replacement.ID) {
+		t.Errorf("the replacement did not evict the parent and its child")
+	}
+}
+
+func TestReplacementSpendingReplaced(t *testing.T) {
+	bc, wallet := testChain(t)
+	coinbase := testMine(t, bc, wallet).Transactions[0]
+	mp := NewMempool(maxMempoolSize, time.Hour)
+
+	pooled := testSpend(wallet, coinbase, 0, coinbase.Vout[0].Value-1)
+	addAll(t, mp, bc, pooled)
+
+	// spends the output the pooled transaction spends and the output it creates
+	tx := &Transaction{"", []TXInput{{coinbase.ID, 0, nil, wallet.PublicKey}, {pooled.ID, 0, nil, wallet.PublicKey}},
+		[]TXOutput{*NewTXOutput(1, string(wallet.GetAddress()))}, transactionVersion}
+	tx.Sign(wallet.PrivateKey, map[string]Transaction{coinbase.ID: *coinbase, pooled.ID: *pooled})
+	tx.ID = string(tx.Hash())
+
+	if err := mp.Add(tx, bc); err == nil || !strings.Contains(err.Error(), "which it replaces") {
+		t.Errorf("got %v, want the transaction spending what it replaces refused", err)
+	}
+}
+
+func TestReplacementLimit(t *testing.T) {
+	bc, wallet := testChain(t)
+	coinbase := testMine(t, bc, wallet).Transactions[0]
+	mp := NewMempool(maxMempoolSize, time.Hour)
+	value := coinbase.Vout[0].Value
+
+	// a chain of maxReplacements+1 transactions paying no fee
+	prev := coinbase
+	for i := 0; i <= maxReplacements; i++ {
+		prev = testSpend(wallet, prev, 0, value)
+		addAll(t, mp, bc, prev)
+	}
+
+	if err := mp.Add(testSpend(wallet, coinbase, 0, 1), bc); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("got %v, want a transaction replacing %d transactions refused", err, maxReplacements+1)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import "fmt"
+
+const messageVersion = 1
+
+// newMessageReader starts reading a message payload, which has to be in the canonical
+// encoding of the current message version
+func newMessageReader(data []byte) *binaryReader {
+	r, version := newBinaryReader(data)
+	if r.err == nil && version != messageVersion {
+		r.fail(fmt.Errorf("unsupported message version %d", version))
+	}
+
+	return r
+}
+
+func writeItems(w *binaryWriter, items [][]byte) {
+	w.writeUvarint(uint64(len(items)))
+	for _, item := range items {
+		w.writeBytes(item)
+	}
+}
+
+func readItems(r *binaryReader) [][]byte {
+	var items [][]byte
+	for i, n := 0, r.readCount(1); i < n; i++ {
+		items = append(items, r.readBytes())
+	}
+
+	return items
+}
+
+func (m addr) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeUvarint(uint64(len(m.AddrList)))
+	for _, address := range m.AddrList {
+		w.writeBytes([]byte(address))
+	}
+
+	return w.Bytes()
+}
+
+func deserializeAddr(data []byte) (addr, error) {
+	var m addr
+	r := newMessageReader(data)
+	for i, n := 0, r.readCount(1); i < n; i++ {
+		m.AddrList = append(m.AddrList, string(r.readBytes()))
+	}
+
+	return m, r.finish()
+}
+
+func (m block) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	w.writeBytes(m.Block)
+
+	return w.Bytes()
+}
+
+func deserializeBlockMessage(data []byte) (block, error) {
+	var m block
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Block = r.readBytes()
+
+	return m, r.finish()
+}
+
+func (m getheaders) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	writeItems(w, m.Locator)
+	w.writeBytes(m.StopHash)
+
+	return w.Bytes()
+}
+
+func deserializeGetHeaders(data []byte) (getheaders, error) {
+	var m getheaders
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Locator = readItems(r)
+	m.StopHash = r.readBytes()
+
+	return m, r.finish()
+}
+
+func (m headers) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	writeItems(w, m.Headers)
+
+	return w.Bytes()
+}
+
+func deserializeHeaders(data []byte) (headers, error) {
+	var m headers
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Headers = readItems(r)
+
+	return m, r.finish()
+}
+
+func (m getdata) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	w.writeBytes([]byte(m.Type))
+	w.writeBytes(m.ID)
+
+	return w.Bytes()
+}
+
+func deserializeGetData(data []byte) (getdata, error) {
+	var m getdata
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Type = string(r.readBytes())
+	m.ID = r.readBytes()
+
+	return m, r.finish()
+}
+
+func (m inv) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	w.writeBytes([]byte(m.Type))
+	writeItems(w, m.Items)
+
+	return w.Bytes()
+}
+
+func deserializeInv(data []byte) (inv, error) {
+	var m inv
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Type = string(r.readBytes())
+	m.Items = readItems(r)
+
+	return m, r.finish()
+}
+
+func (m reject) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddrFrom))
+	w.writeBytes([]byte(m.Kind))
+	w.writeUvarint(uint64(m.Reason))
+	w.writeBytes(m.ID)
+	w.writeBytes([]byte(m.Message))
+
+	return w.Bytes()
+}
+
+func deserializeReject(data []byte) (reject, error) {
+	var m reject
+	r := newMessageReader(data)
+	m.AddrFrom = string(r.readBytes())
+	m.Kind = string(r.readBytes())
+	m.Reason = RejectReason(r.readUvarint())
+	m.ID = r.readBytes()
+	m.Message = string(r.readBytes())
+
+	return m, r.finish()
+}
+
+func (m tx) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeBytes([]byte(m.AddFrom))
+	w.writeBytes(m.Transaction)
+
+	return w.Bytes()
+}
+
+func deserializeTxMessage(data []byte) (tx, error) {
+	var m tx
+	r := newMessageReader(data)
+	m.AddFrom = string(r.readBytes())
+	m.Transaction = r.readBytes()
+
+	return m, r.finish()
+}
+
+func (m ping) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeUint64(m.Nonce)
+
+	return w.Bytes()
+}
+
+func deserializePing(data []byte) (ping, error) {
+	var m ping
+	r := newMessageReader(data)
+	m.Nonce = r.readUint64()
+
+	return m, r.finish()
+}
+
+func (m pong) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeUint64(m.Nonce)
+
+	return w.Bytes()
+}
+
+func deserializePong(data []byte) (pong, error) {
+	var m pong
+	r := newMessageReader(data)
+	m.Nonce = r.readUint64()
+
+	return m, r.finish()
+}
+
+func (m verzion) Serialize() []byte {
+	w := newBinaryWriter(messageVersion)
+	w.writeVarint(int64(m.Version))
+	w.writeUint64(m.Services)
+	w.writeVarint(int64(m.BestHeight))
+	w.writeBytes(m.ChainWork)
+	w.writeBytes([]byte(m.AddrFrom))
+
+	return w.Bytes()
+}
+
+func deserializeVersion(data []byte) (verzion, error) {
+	var m verzion
+	r := newMessageReader(data)
+	m.Version = r.readInt()
+	m.Services = r.readUint64()
+	m.BestHeight = r.readInt()
+	m.ChainWork = r.readBytes()
+	m.AddrFrom = string(r.readBytes())
+
+	return m, r.finish()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"os"
+)
+
+// The first version opened the database under the unformatted dbFile name and saved the
+// wallets under walletFile without a placeholder, which fmt completed like this
+const legacyWalletFile = "wallet.dat%%!(EXTRA string=%s)"
+
+// migrateDB rewrites the blocks and undo data stored with gob in the canonical encoding
+// and rebuilds the UTXO set from the blocks. Blocks keep their version, so their hashes do
+// not change. Files saved under the names of the first version are renamed.
+func (cli *CLI) migrateDB(nodeID string) {
+	migrateFile(dbFile, fmt.Sprintf(dbFile, nodeID))
+	migrateFile(fmt.Sprintf(legacyWalletFile, nodeID), fmt.Sprintf(walletFile, nodeID))
+
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	isTipKey := func(key []byte) bool { return string(key) == "l" }
+	noKey := func(key []byte) bool { return false }
+
+	// the UTXO set went through layouts that cannot all be told apart, so it is rebuilt
+	// instead of decoded
+	reindex := false
+
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		blocks, err := migrateBucket(tx.Bucket([]byte(blocksBucket)), isTipKey, func(value []byte) ([]byte, error) {
+			block, err := decodeLegacyBlock(value)
+			if err != nil {
+				return nil, err
+			}
+
+			return block.Serialize(), nil
+		})
+		if err != nil {
+			return err
+		}
+
+		utxo := tx.Bucket([]byte(utxoBucket))
+		reindex = blocks > 0 || utxo == nil || hasLegacyValues(utxo)
+
+		undos := 0
+		if b := tx.Bucket([]byte(undoBucket)); b != nil {
+			undos, err = migrateBucket(b, noKey, func(value []byte) ([]byte, error) {
+				undo, err := decodeLegacyBlockUndo(value)
+
+				return undo.Serialize(), err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Migrated %d blocks and %d undo records.\n", blocks, undos)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if reindex {
+		UTXOSet := UTXOSet{bc}
+		UTXOSet.Reindex()
+		fmt.Printf("Rebuilt the UTXO set with %d transactions.\n", UTXOSet.CountTransactions())
+	}
+}
+
+// migrateFile renames a file to the name it is read from, unless a file has that name already
+func migrateFile(oldPath, newPath string) {
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		return
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		return
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Renamed %s to %s.\n", oldPath, newPath)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var maxNonce = math.MaxInt64
+
+// miningThreads is the number of workers used to mine blocks, set with startnode -threads
+var miningThreads = runtime.NumCPU()
+
+// Workers check for cancellation and publish their hash count every hashBatch hashes
+const hashBatch = 1 << 12
+const hashrateInterval = 10 * time.Second
+
+// Miner searches for proof of work with several workers, each taking every n-th nonce
+type Miner struct {
+	Threads int
+
+	hashes   uint64
+	hashrate uint64
+}
+
+func NewMiner(threads int) *Miner {
+	if threads < 1 {
+		threads = 1
+	}
+
+	return &Miner{Threads: threads}
+}
+
+// Mine looks for a nonce that brings the header hash below the block target and sets the
+// block nonce and hash. When the nonce space runs out the timestamp is moved forward and
+// the search starts over. It returns the context error if the context is done first.
+func (m *Miner) Mine(ctx context.Context, block *Block) error {
+	target := CompactToBig(block.Bits)
+	start := time.Now()
+	atomic.StoreUint64(&m.hashes, 0)
+
+	fmt.Printf("Mining a new block with %d threads\n", m.Threads)
+
+	done := make(chan struct{})
+	defer close(done)
+	go m.reportHashrate(start, done)
+
+	for {
+		nonce, found := m.search(ctx, block.BlockHeader, target)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if found {
+			block.Nonce = nonce
+			block.Hash = string(block.BlockHeader.Hash())
+
+			m.updateHashrate(start)
+			fmt.Printf("Found block %x after %d hashes (%d H/s)\n", block.Hash, atomic.LoadUint64(&m.hashes), m.Hashrate())
+
+			return nil
+		}
+
+		block.Timestamp++
+		if now := time.Now().Unix(); now > block.Timestamp {
+			block.Timestamp = now
+		}
+	}
+}
+
+// Hashrate returns the hashes per second measured during the last or current search
+func (m *Miner) Hashrate() uint64 {
+	return atomic.LoadUint64(&m.hashrate)
+}
+
+// search runs the workers over the whole nonce space of the header. It reports false if
+// no nonce was found or the context was cancelled.
+func (m *Miner) search(ctx context.Context, header BlockHeader, target *big.Int) (int, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan int, m.Threads)
+	var wg sync.WaitGroup
+
+	for i := 0; i < m.Threads; i++ {
+		wg.Add(1)
+
+		go func(first int) {
+			defer wg.Done()
+
+			data := header.Serialize()
+			var hashInt big.Int
+			count := uint64(0)
+
+			// the nonce turns negative when stepping past maxNonce overflows
+			for nonce := first; nonce >= 0 && nonce <= maxNonce; nonce += m.Threads {
+				if count++; count%hashBatch == 0 {
+					atomic.AddUint64(&m.hashes, hashBatch)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+
+				setNonce(data, nonce)
+				hash := sha256.Sum256(data)
+				hashInt.SetBytes(hash[:])
+
+				if hashInt.Cmp(target) == -1 {
+					atomic.AddUint64(&m.hashes, count%hashBatch)
+					results <- nonce
+					cancel()
+					return
+				}
+			}
+			atomic.AddUint64(&m.hashes, count%hashBatch)
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case nonce := <-results:
+		return nonce, true
+	default:
+		return 0, false
+	}
+}
+
+func (m *Miner) reportHashrate(start time.Time, done chan struct{}) {
+	ticker := time.NewTicker(hashrateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			m.updateHashrate(start)
+			fmt.Printf("Mining at %d H/s\n", m.Hashrate())
+		}
+	}
+}
+
+func (m *Miner) updateHashrate(start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	if elapsed > 0 {
+		atomic.StoreUint64(&m.hashrate, uint64(float64(atomic.LoadUint64(&m.hashes))/elapsed))
+	}
+}
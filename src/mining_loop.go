@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// After a mined block is rejected the miner waits rejectedBlockDelay before the next one
+const rejectedBlockDelay = 10 * time.Second
+
+// newTransactions wakes the miner up when a transaction enters the mempool
+var newTransactions = make(chan struct{}, 1)
+
+// MinerConfig controls when the background miner starts a block and what goes into it
+type MinerConfig struct {
+	// Address receives the block rewards
+	Address string
+	// MinTxs is the number of transactions that starts a block right away
+	MinTxs int
+	// Policy limits the block and orders its transactions
+	Policy BlockPolicy
+	// BlockInterval is how long to wait for MinTxs transactions after the last block
+	// before mining with what the mempool holds, down to a coinbase alone
+	BlockInterval time.Duration
+}
+
+// mineBlocks mines blocks on top of the tip for as long as the node runs. It looks at the
+// mempool again whenever a transaction arrives, the tip moves or the block interval passes.
+func mineBlocks(bc *Blockchain, config MinerConfig) {
+	lastBlock := time.Now()
+	assembler := NewBlockAssembler(config.Policy)
+
+	for {
+		tipChanged := bc.TipChanged()
+		txs, fees := assembler.Assemble(mempool)
+
+		if wait := config.BlockInterval - time.Since(lastBlock); len(txs) < config.MinTxs && wait > 0 {
+			select {
+			case <-newTransactions:
+			case <-tipChanged:
+				lastBlock = time.Now()
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		// the transactions were picked for a tip that is gone
+		select {
+		case <-tipChanged:
+			continue
+		default:
+		}
+
+		newBlock, err := bc.MineBlock(context.Background(), config.Address, txs, fees)
+		if _, ok := err.(*BlockValidationError); ok {
+			// the transactions that are still valid are assembled again after a delay
+			fmt.Printf("Mined block rejected: %s\n", err)
+			mempool.RemoveRejected(txs, bc)
+			select {
+			case <-tipChanged:
+			case <-time.After(rejectedBlockDelay):
+			}
+			lastBlock = time.Now()
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Mining stopped: %s\n", err)
+			lastBlock = time.Now()
+			continue
+		}
+		lastBlock = time.Now()
+
+		fmt.Printf("New block is mined with %d transactions paying %d in fees!\n", len(txs), fees)
+
+		mempool.RemoveForBlock(newBlock)
+		announceBlock(newBlock)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const maxOrphanBlocks = 50
+
+type orphanBlock struct {
+	Block *Block
+	Peer  *Peer
+	Added time.Time
+}
+
+// OrphanBlockPool holds blocks that passed the context-free checks but whose parent is not
+// known yet, indexed by the missing parent
+type OrphanBlockPool struct {
+	mutex    sync.Mutex
+	blocks   map[string]*orphanBlock
+	byParent map[string][]string
+}
+
+func NewOrphanBlockPool() *OrphanBlockPool {
+	return &OrphanBlockPool{
+		blocks:   make(map[string]*orphanBlock),
+		byParent: make(map[string][]string),
+	}
+}
+
+// Add keeps a block received from peer until its parent arrives and reports whether it was
+// new. When the pool is full the oldest orphan is dropped.
+func (op *OrphanBlockPool) Add(block *Block, peer *Peer) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	if _, ok := op.blocks[block.Hash]; ok {
+		return false
+	}
+
+	for len(op.blocks) >= maxOrphanBlocks {
+		var oldest *orphanBlock
+		for _, orphan := range op.blocks {
+			if oldest == nil || orphan.Added.Before(oldest.Added) {
+				oldest = orphan
+			}
+		}
+		op.remove(oldest.Block.Hash)
+	}
+
+	op.blocks[block.Hash] = &orphanBlock{block, peer, time.Now()}
+	op.byParent[block.PreviousHash] = append(op.byParent[block.PreviousHash], block.Hash)
+
+	return true
+}
+
+func (op *OrphanBlockPool) Has(hash string) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	_, ok := op.blocks[hash]
+
+	return ok
+}
+
+func (op *OrphanBlockPool) Count() int {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	return len(op.blocks)
+}
+
+// MissingAncestor follows the orphans back from the block and returns the hash of the first
+// ancestor that is not in the pool, the one to request next
+func (op *OrphanBlockPool) MissingAncestor(hash string) string {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	for {
+		orphan, ok := op.blocks[hash]
+		if !ok {
+			return hash
+		}
+		hash = orphan.Block.PreviousHash
+	}
+}
+
+// TakeChildren removes and returns the orphans whose parent is the block
+func (op *OrphanBlockPool) TakeChildren(parent string) []*orphanBlock {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	var children []*orphanBlock
+	for _, hash := range op.byParent[parent] {
+		children = append(children, op.blocks[hash])
+		delete(op.blocks, hash)
+	}
+	delete(op.byParent, parent)
+
+	return children
+}
+
+func (op *OrphanBlockPool) remove(hash string) {
+	orphan := op.blocks[hash]
+	parent := orphan.Block.PreviousHash
+
+	siblings := op.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byParent, parent)
+	} else {
+		op.byParent[parent] = siblings
+	}
+	delete(op.blocks, hash)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits of the orphan pool: the number of orphans kept, in total and per peer, the size of
+// a single orphan and how long it waits for its parents
+const maxOrphans = 100
+const maxOrphansPerPeer = 25
+const maxOrphanSize = 100 * 1024
+const orphanExpiry = 20 * time.Minute
+
+type orphanEntry struct {
+	Tx      *Transaction
+	Peer    string
+	Parents []string
+	Added   time.Time
+}
+
+// OrphanPool holds transactions whose parents are unknown until the parents arrive in the
+// mempool or in a block. Orphans are indexed by the parents they miss.
+type OrphanPool struct {
+	mutex    sync.Mutex
+	orphans  map[string]*orphanEntry
+	byParent map[string]map[string]bool
+	perPeer  map[string]int
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans:  make(map[string]*orphanEntry),
+		byParent: make(map[string]map[string]bool),
+		perPeer:  make(map[string]int),
+	}
+}
+
+// Add keeps a transaction received from peer until its missing parents arrive. When the
+// pool is full a random orphan is evicted to make room.
+func (op *OrphanPool) Add(tx *Transaction, peer string, parents []string) error {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	op.expire(time.Now())
+
+	if _, ok := op.orphans[tx.ID]; ok {
+		return errors.New("the transaction is already an orphan")
+	}
+	if size := len(tx.Serialize()); size > maxOrphanSize {
+		return fmt.Errorf("the orphan is %d bytes, more than %d", size, maxOrphanSize)
+	}
+	if op.perPeer[peer] >= maxOrphansPerPeer {
+		return fmt.Errorf("%s already sent %d orphans", peer, maxOrphansPerPeer)
+	}
+
+	// map iteration order is random, which makes the evicted orphans hard to target
+	for id := range op.orphans {
+		if len(op.orphans) < maxOrphans {
+			break
+		}
+		op.remove(id)
+	}
+
+	op.orphans[tx.ID] = &orphanEntry{tx, peer, parents, time.Now()}
+	for _, parent := range parents {
+		if op.byParent[parent] == nil {
+			op.byParent[parent] = make(map[string]bool)
+		}
+		op.byParent[parent][tx.ID] = true
+	}
+	op.perPeer[peer]++
+
+	return nil
+}
+
+func (op *OrphanPool) Has(id string) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	_, ok := op.orphans[id]
+
+	return ok
+}
+
+func (op *OrphanPool) Count() int {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	return len(op.orphans)
+}
+
+// Children returns the orphans waiting for the transaction
+func (op *OrphanPool) Children(parent string) []*orphanEntry {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	var children []*orphanEntry
+	for id := range op.byParent[parent] {
+		children = append(children, op.orphans[id])
+	}
+
+	return children
+}
+
+func (op *OrphanPool) Remove(id string) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	if _, ok := op.orphans[id]; ok {
+		op.remove(id)
+	}
+}
+
+// RemoveForBlock removes the orphans confirmed by the block and the ones spending the same
+// outputs as its transactions
+func (op *OrphanPool) RemoveForBlock(block *Block) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	spent := make(map[Outpoint]bool)
+	for _, tx := range block.Transactions {
+		if _, ok := op.orphans[tx.ID]; ok {
+			op.remove(tx.ID)
+		}
+		for _, vin := range tx.Vin {
+			spent[Outpoint{vin.TxID, vin.Vout}] = true
+		}
+	}
+
+	for id, orphan := range op.orphans {
+		for _, vin := range orphan.Tx.Vin {
+			if spent[Outpoint{vin.TxID, vin.Vout}] {
+				op.remove(id)
+				break
+			}
+		}
+	}
+}
+
+func (op *OrphanPool) remove(id string) {
+	orphan := op.orphans[id]
+
+	for _, parent := range orphan.Parents {
+		delete(op.byParent[parent], id)
+		if len(op.byParent[parent]) == 0 {
+			delete(op.byParent, parent)
+		}
+	}
+	if op.perPeer[orphan.Peer]--; op.perPeer[orphan.Peer] == 0 {
+		delete(op.perPeer, orphan.Peer)
+	}
+	delete(op.orphans, id)
+}
+
+func (op *OrphanPool) expire(now time.Time) {
+	for id, orphan := range op.orphans {
+		if now.Sub(orphan.Added) > orphanExpiry {
+			op.remove(id)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message starts with a header made of the network magic, the command padded with
+// zeros to commandLength bytes, the little-endian payload length and the first bytes of the
+// double SHA-256 of the payload
+const commandLength = 12
+const checksumLength = 4
+const messageHeaderLength = len(networkMagic) + commandLength + 4 + checksumLength
+
+var networkMagic = [4]byte{0xb1, 0x0c, 0x4c, 0xa1}
+
+var errBadMagic = errors.New("the message does not start with the network magic")
+var errBadChecksum = errors.New("the message checksum does not match its payload")
+
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range command {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", command)
+}
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("command %q is longer than %d bytes", command, commandLength)
+	}
+
+	var message bytes.Buffer
+	message.Write(networkMagic[:])
+	message.Write(commandToBytes(command))
+	_ = binary.Write(&message, binary.LittleEndian, uint32(len(payload)))
+	message.Write(messageChecksum(payload))
+	message.Write(payload)
+
+	_, err := w.Write(message.Bytes())
+
+	return err
+}
+
+// readMessage reads the next message and returns its command and payload. The length is
+// checked before the payload is read, so a peer cannot make the node allocate more than
+// maxMessageSize bytes.
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, messageHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+
+	if !bytes.Equal(header[:len(networkMagic)], networkMagic[:]) {
+		return "", nil, errBadMagic
+	}
+	header = header[len(networkMagic):]
+
+	command := bytesToCommand(header[:commandLength])
+	length := binary.LittleEndian.Uint32(header[commandLength:])
+	checksum := header[commandLength+4:]
+
+	if length > maxMessageSize {
+		return "", nil, fmt.Errorf("%s message of %d bytes is larger than %d", command, length, maxMessageSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(checksum, messageChecksum(payload)) {
+		return "", nil, errBadChecksum
+	}
+
+	return command, payload, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// ChainParams holds the consensus parameters. Every node of a network has to run with
+// the same values, they can be overridden through environment variables for test networks.
+type ChainParams struct {
+	// TargetBlockTime is the desired number of seconds between blocks
+	TargetBlockTime int64
+	// RetargetInterval is the number of blocks between difficulty adjustments
+	RetargetInterval int
+	// InitialTargetBits is the number of leading zero bits the genesis block hash must have
+	InitialTargetBits uint
+	// InitialSubsidy is the reward of the first blocks
+	InitialSubsidy int
+	// HalvingInterval is the number of blocks after which the subsidy halves
+	HalvingInterval int
+	// CoinbaseMaturity is the number of blocks to wait before a coinbase output can be spent
+	CoinbaseMaturity int
+}
+
+var chainParams = ChainParams{
+	TargetBlockTime:   10,
+	RetargetInterval:  10,
+	InitialTargetBits: 24,
+	InitialSubsidy:    10,
+	HalvingInterval:   210,
+	CoinbaseMaturity:  10,
+}
+
+// loadChainParams applies the overrides found in the environment
+func loadChainParams() {
+	if value := os.Getenv("TARGET_BLOCK_TIME"); value != "" {
+		chainParams.TargetBlockTime = int64(parseParam("TARGET_BLOCK_TIME", value, 1))
+	}
+	if value := os.Getenv("RETARGET_INTERVAL"); value != "" {
+		chainParams.RetargetInterval = parseParam("RETARGET_INTERVAL", value, 2)
+	}
+	if value := os.Getenv("INITIAL_TARGET_BITS"); value != "" {
+		bits := parseParam("INITIAL_TARGET_BITS", value, 1)
+		// a single leading zero bit would allow targets above powLimit
+		if bits > 256 || CompactToBig(targetBitsToCompact(uint(bits))).Cmp(powLimit) > 0 {
+			log.Panicf("ERROR: INITIAL_TARGET_BITS of %d gives a target out of range", bits)
+		}
+		chainParams.InitialTargetBits = uint(bits)
+	}
+	if value := os.Getenv("INITIAL_SUBSIDY"); value != "" {
+		chainParams.InitialSubsidy = parseParam("INITIAL_SUBSIDY", value, 0)
+	}
+	if value := os.Getenv("HALVING_INTERVAL"); value != "" {
+		chainParams.HalvingInterval = parseParam("HALVING_INTERVAL", value, 1)
+	}
+	if value := os.Getenv("COINBASE_MATURITY"); value != "" {
+		chainParams.CoinbaseMaturity = parseParam("COINBASE_MATURITY", value, 0)
+	}
+}
+
+func parseParam(name, value string, min int) int {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min {
+		log.Panicf("ERROR: %s must be a number not lower than %d", name, min)
+	}
+
+	return parsed
+}
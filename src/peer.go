@@ -0,0 +1,748 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// serviceNetwork is announced by nodes that keep the chain and relay blocks and transactions.
+// Wallets sending a transaction announce no service.
+const serviceNetwork uint64 = 1
+
+const defaultMaxInbound = 117
+const defaultMaxOutbound = 8
+
+// handshakeTimeout is how long a peer has to complete the version/verack exchange
+const handshakeTimeout = 30 * time.Second
+
+// Ready peers are pinged every pingInterval and disconnected when the pong does not come
+// back within pingTimeout
+const pingInterval = time.Minute
+const pingTimeout = 30 * time.Second
+
+// A peer may advertise addrTokenRate addresses per second on average, in bursts of at most
+// maxAddrPerMessage. Addresses asked with getaddr do not count.
+const addrTokenRate = 0.1
+const maxAddrPerMessage = 1000
+const initialAddrTokens = addrGossipSize
+
+var errTooManyPeers = errors.New("the outbound peer limit is reached")
+var errBanned = errors.New("the peer is banned")
+
+// Peer is a connected node and what is known about it. Messages other than the handshake are
+// only exchanged once both sides sent their version and acknowledged the other's.
+type Peer struct {
+	*Connection
+
+	mutex           sync.Mutex
+	version         int
+	services        uint64
+	bestHeight      int
+	chainWork       *big.Int
+	lastSeen        time.Time
+	versionReceived bool
+	verackReceived  bool
+	ready           chan struct{}
+	// pending holds the messages sent before the handshake completed
+	pending  []message
+	inFlight map[string]time.Time
+	// pingNonce is the nonce of the ping waiting for its pong, 0 when there is none
+	pingNonce uint64
+	pingSent  time.Time
+	latency   time.Duration
+	pong      chan struct{}
+	readyAt   time.Time
+	// misbehavior is the score of what the peer did wrong on this connection
+	misbehavior int
+	// addrTokens is how many more addresses the peer may advertise, refilled over time
+	addrTokens        float64
+	addrTokensUpdated time.Time
+	getaddrAnswered   bool
+}
+
+func newPeer(c *Connection) *Peer {
+	return &Peer{
+		Connection:        c,
+		chainWork:         new(big.Int),
+		lastSeen:          time.Now(),
+		ready:             make(chan struct{}),
+		inFlight:          make(map[string]time.Time),
+		pong:              make(chan struct{}, 1),
+		addrTokens:        initialAddrTokens,
+		addrTokensUpdated: time.Now(),
+	}
+}
+
+// Send queues a message, holding it until the handshake completes
+func (p *Peer) Send(command string, payload []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isReady() {
+		if len(p.pending) >= sendQueueLength {
+			p.Close()
+			return fmt.Errorf("%s did not complete the handshake", p)
+		}
+		p.pending = append(p.pending, message{command, payload})
+		return nil
+	}
+
+	return p.Connection.Send(command, payload)
+}
+
+// Ready reports whether the handshake is complete
+func (p *Peer) Ready() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.isReady()
+}
+
+func (p *Peer) isReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Version returns the protocol version negotiated with the peer
+func (p *Peer) Version() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.version
+}
+
+func (p *Peer) Services() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.services
+}
+
+func (p *Peer) BestHeight() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.bestHeight
+}
+
+func (p *Peer) ChainWork() *big.Int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return new(big.Int).Set(p.chainWork)
+}
+
+func (p *Peer) LastSeen() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.lastSeen
+}
+
+// UpdateBestHeight records that the peer has a block at the height
+func (p *Peer) UpdateBestHeight(height int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if height > p.bestHeight {
+		p.bestHeight = height
+	}
+}
+
+// Request records an item asked from the peer with getdata
+func (p *Peer) Request(kind string, id []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.inFlight[inventoryKey(kind, id)] = time.Now()
+}
+
+// Received removes an item from the requests in flight and reports whether it was requested
+func (p *Peer) Received(kind string, id []byte) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := inventoryKey(kind, id)
+	_, ok := p.inFlight[key]
+	delete(p.inFlight, key)
+
+	return ok
+}
+
+func (p *Peer) Requested(kind string, id []byte) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, ok := p.inFlight[inventoryKey(kind, id)]
+
+	return ok
+}
+
+func (p *Peer) InFlight() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.inFlight)
+}
+
+// ReadyAt returns when the handshake completed
+func (p *Peer) ReadyAt() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.readyAt
+}
+
+// Latency returns the round trip time of the last ping, 0 before the first pong
+func (p *Peer) Latency() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.latency
+}
+
+// AllowAddrs takes tokens for n advertised addresses and returns how many of them may be
+// processed, the others are ignored
+func (p *Peer) AllowAddrs(n int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	p.addrTokens += now.Sub(p.addrTokensUpdated).Seconds() * addrTokenRate
+	if p.addrTokens > maxAddrPerMessage {
+		p.addrTokens = maxAddrPerMessage
+	}
+	p.addrTokensUpdated = now
+
+	if allowed := int(p.addrTokens); allowed < n {
+		n = allowed
+	}
+	p.addrTokens -= float64(n)
+
+	return n
+}
+
+// ExpectAddrs gives tokens for the addresses of the reply to a getaddr
+func (p *Peer) ExpectAddrs(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.addrTokens += float64(n)
+}
+
+// AnswerGetAddr reports whether a getaddr from the peer should be answered, only the first
+// one is so the whole address book cannot be scraped
+func (p *Peer) AnswerGetAddr() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	answer := !p.getaddrAnswered
+	p.getaddrAnswered = true
+
+	return answer
+}
+
+func (p *Peer) seen() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.lastSeen = time.Now()
+}
+
+// completeHandshake marks the peer ready once both the version and the verack arrived and
+// sends the messages held until then. It reports whether the handshake completed just now.
+func (p *Peer) completeHandshake() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.versionReceived || !p.verackReceived || p.isReady() {
+		return false
+	}
+
+	close(p.ready)
+	p.readyAt = time.Now()
+	for _, msg := range p.pending {
+		_ = p.Connection.Send(msg.command, msg.payload)
+	}
+	p.pending = nil
+
+	return true
+}
+
+func inventoryKey(kind string, id []byte) string {
+	return kind + ":" + string(id)
+}
+
+// PeerManager keeps the connected peers, indexed by the listening address of the remote node
+// once it is known. It performs the handshake, pings the peers to find the dead connections
+// and hands the other messages to Handle.
+type PeerManager struct {
+	// Handle processes a message received from a peer after the handshake. Without a
+	// handler, as in the CLI, those messages are dropped.
+	Handle func(p *Peer, command string, payload []byte)
+	// OnReady is called when a peer completes the handshake
+	OnReady func(p *Peer)
+	// OnDisconnect is called when the connection to a peer is gone, ready or not
+	OnDisconnect func(p *Peer)
+	// LocalVersion returns the version message sent to peers
+	LocalVersion func() verzion
+
+	MaxInbound  int
+	MaxOutbound int
+
+	mutex  sync.Mutex
+	peers  map[*Peer]bool
+	byAddr map[string]*Peer
+	// banned holds when the bans of hosts refused for misbehavior end, by banKey
+	banned map[string]time.Time
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{
+		MaxInbound:  defaultMaxInbound,
+		MaxOutbound: defaultMaxOutbound,
+		peers:       make(map[*Peer]bool),
+		byAddr:      make(map[string]*Peer),
+		banned:      make(map[string]time.Time),
+	}
+}
+
+// Serve runs an inbound connection until it is closed
+func (pm *PeerManager) Serve(conn net.Conn) {
+	p := newPeer(newConnection(conn, "", false))
+
+	pm.mutex.Lock()
+	if pm.isBanned(p.Connection) {
+		pm.mutex.Unlock()
+		fmt.Printf("Refusing %s: the host is banned\n", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	if pm.count(false) >= pm.MaxInbound {
+		pm.mutex.Unlock()
+		fmt.Printf("Refusing %s: there are %d inbound peers already\n", conn.RemoteAddr(), pm.MaxInbound)
+		_ = conn.Close()
+		return
+	}
+	pm.peers[p] = true
+	pm.mutex.Unlock()
+
+	pm.start(p)
+	pm.run(p)
+}
+
+// Connect returns the peer listening on addr, dialing it if there is no connection yet
+func (pm *PeerManager) Connect(addr string) (*Peer, error) {
+	pm.mutex.Lock()
+	p, ok := pm.byAddr[addr]
+	full := pm.count(true) >= pm.MaxOutbound
+	pm.mutex.Unlock()
+	if ok {
+		return p, nil
+	}
+	if full {
+		return nil, errTooManyPeers
+	}
+
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p = newPeer(newConnection(conn, addr, true))
+	pm.mutex.Lock()
+	if pm.isBanned(p.Connection) {
+		pm.mutex.Unlock()
+		_ = conn.Close()
+		return nil, errBanned
+	}
+	if existing, ok := pm.byAddr[addr]; ok {
+		// another goroutine connected in the meantime
+		pm.mutex.Unlock()
+		_ = conn.Close()
+		return existing, nil
+	}
+	if pm.count(true) >= pm.MaxOutbound {
+		pm.mutex.Unlock()
+		_ = conn.Close()
+		return nil, errTooManyPeers
+	}
+	pm.peers[p] = true
+	pm.byAddr[addr] = p
+	pm.mutex.Unlock()
+
+	pm.start(p)
+	_ = p.Connection.Send("version", pm.localVersion().Serialize())
+	go pm.run(p)
+
+	return p, nil
+}
+
+func (pm *PeerManager) start(p *Peer) {
+	go p.writeLoop()
+	time.AfterFunc(handshakeTimeout, func() {
+		if !p.Ready() {
+			fmt.Printf("Disconnecting %s: no handshake after %s\n", p, handshakeTimeout)
+			p.Close()
+		}
+	})
+}
+
+func (pm *PeerManager) run(p *Peer) {
+	p.readLoop(func(_ *Connection, command string, payload []byte) {
+		pm.receive(p, command, payload)
+	})
+	pm.remove(p)
+}
+
+func (pm *PeerManager) receive(p *Peer, command string, payload []byte) {
+	p.seen()
+
+	var err error
+	switch {
+	case command == "version":
+		err = pm.handleVersion(p, payload)
+	case command == "verack":
+		err = pm.handleVerack(p)
+	case !p.Ready():
+		err = fmt.Errorf("%s message before the handshake", command)
+	case command == "ping":
+		err = pm.handlePing(p, payload)
+	case command == "pong":
+		err = pm.handlePong(p, payload)
+	case pm.Handle != nil:
+		pm.Handle(p, command, payload)
+	}
+
+	if err != nil {
+		fmt.Printf("Disconnecting %s: %s\n", p, err)
+		p.Close()
+	}
+}
+
+func (pm *PeerManager) handleVersion(p *Peer, data []byte) error {
+	payload, err := deserializeVersion(data)
+	if err != nil {
+		return err
+	}
+
+	if payload.Version < minProtocolVersion {
+		return fmt.Errorf("protocol version %d is older than %d", payload.Version, minProtocolVersion)
+	}
+
+	p.mutex.Lock()
+	if p.versionReceived {
+		p.mutex.Unlock()
+		return errors.New("duplicate version message")
+	}
+	p.versionReceived = true
+	p.version = nodeVersion
+	if payload.Version < nodeVersion {
+		p.version = payload.Version
+	}
+	p.services = payload.Services
+	p.bestHeight = payload.BestHeight
+	p.chainWork = new(big.Int).SetBytes(payload.ChainWork)
+	p.mutex.Unlock()
+
+	pm.Identify(p, payload.AddrFrom)
+	if !p.Outbound {
+		_ = p.Connection.Send("version", pm.localVersion().Serialize())
+	}
+	_ = p.Connection.Send("verack", nil)
+
+	pm.completeHandshake(p)
+
+	return nil
+}
+
+func (pm *PeerManager) handleVerack(p *Peer) error {
+	p.mutex.Lock()
+	// inbound peers only get the version of this node in reply to theirs
+	if !p.Outbound && !p.versionReceived {
+		p.mutex.Unlock()
+		return errors.New("verack before version")
+	}
+	p.verackReceived = true
+	p.mutex.Unlock()
+
+	pm.completeHandshake(p)
+
+	return nil
+}
+
+func (pm *PeerManager) handlePing(p *Peer, data []byte) error {
+	payload, err := deserializePing(data)
+	if err != nil {
+		return err
+	}
+
+	return p.Send("pong", pong{payload.Nonce}.Serialize())
+}
+
+func (pm *PeerManager) handlePong(p *Peer, data []byte) error {
+	payload, err := deserializePong(data)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// a pong for an older ping, which timed out, is ignored
+	if p.pingNonce == 0 || payload.Nonce != p.pingNonce {
+		return nil
+	}
+	p.pingNonce = 0
+	p.latency = time.Since(p.pingSent)
+	select {
+	case p.pong <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (pm *PeerManager) completeHandshake(p *Peer) {
+	if !p.completeHandshake() {
+		return
+	}
+
+	go pm.keepAlive(p)
+	if pm.OnReady != nil {
+		pm.OnReady(p)
+	}
+}
+
+// keepAlive pings a ready peer until the connection is closed and closes it when a pong is
+// late, which also catches the connections that died without being closed
+func (pm *PeerManager) keepAlive(p *Peer) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closed:
+			return
+		}
+
+		p.mutex.Lock()
+		nonce := rand.Uint64() | 1
+		p.pingNonce = nonce
+		p.pingSent = time.Now()
+		p.mutex.Unlock()
+		if err := p.Send("ping", ping{nonce}.Serialize()); err != nil {
+			return
+		}
+
+		select {
+		case <-p.pong:
+		case <-time.After(pingTimeout):
+			fmt.Printf("Disconnecting %s: no pong within %s\n", p, pingTimeout)
+			p.Close()
+			return
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (pm *PeerManager) localVersion() verzion {
+	if pm.LocalVersion == nil {
+		return verzion{Version: nodeVersion}
+	}
+
+	return pm.LocalVersion()
+}
+
+// Identify records the listening address announced by the node on an inbound connection.
+// An address that already has a connection keeps it.
+func (pm *PeerManager) Identify(p *Peer, addr string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if p.Addr != "" || addr == "" {
+		return
+	}
+	p.Addr = addr
+	if _, ok := pm.byAddr[addr]; !ok {
+		pm.byAddr[addr] = p
+	}
+}
+
+// Get returns the peer listening on addr, or nil when it is not connected
+func (pm *PeerManager) Get(addr string) *Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.byAddr[addr]
+}
+
+// ReadyPeers returns the peers that completed the handshake
+func (pm *PeerManager) ReadyPeers() []*Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var ready []*Peer
+	for p := range pm.peers {
+		if p.Ready() {
+			ready = append(ready, p)
+		}
+	}
+
+	return ready
+}
+
+// Requested reports whether an item was asked from any peer and has not arrived yet
+func (pm *PeerManager) Requested(kind string, id []byte) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for p := range pm.peers {
+		if p.Requested(kind, id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// banKey returns what a ban of the connection applies to. Bans go by host since the address
+// a node announces is not checked, except on loopback, which every node running on this
+// machine shares. Those are told apart by their listening address, empty until it is known.
+func banKey(c *Connection) string {
+	if ip := net.ParseIP(c.Host); ip != nil && ip.IsLoopback() {
+		return c.Addr
+	}
+
+	return c.Host
+}
+
+// isBanned reports whether the connection is banned, forgetting a ban that ended. The caller
+// holds pm.mutex.
+func (pm *PeerManager) isBanned(c *Connection) bool {
+	key := banKey(c)
+	until, ok := pm.banned[key]
+	if ok && time.Now().After(until) {
+		delete(pm.banned, key)
+		return false
+	}
+
+	return ok
+}
+
+// Misbehaving adds to the misbehavior score of a peer. Once it reaches banThreshold the peer
+// is banned for banDuration and all connections the ban applies to are closed. It reports
+// whether the peer was banned just now.
+func (pm *PeerManager) Misbehaving(p *Peer, score int) bool {
+	if score == 0 {
+		return false
+	}
+
+	p.mutex.Lock()
+	p.misbehavior += score
+	exceeded := p.misbehavior >= banThreshold
+	p.mutex.Unlock()
+	if !exceeded {
+		return false
+	}
+
+	pm.mutex.Lock()
+	key := banKey(p.Connection)
+	if key == "" || pm.isBanned(p.Connection) {
+		pm.mutex.Unlock()
+		// there is nothing to ban a local node by before it announces its address
+		p.Close()
+		return false
+	}
+	pm.banned[key] = time.Now().Add(banDuration)
+	var matching []*Peer
+	for other := range pm.peers {
+		if banKey(other.Connection) == key {
+			matching = append(matching, other)
+		}
+	}
+	pm.mutex.Unlock()
+
+	p.Close()
+	for _, other := range matching {
+		other.Close()
+	}
+
+	return true
+}
+
+// Banned reports whether the peer is banned
+func (pm *PeerManager) Banned(p *Peer) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.isBanned(p.Connection)
+}
+
+// CloseAll waits for the handshakes in progress, sends the queued messages and closes every
+// connection, for processes that exit right after sending
+func (pm *PeerManager) CloseAll() {
+	pm.mutex.Lock()
+	var all []*Peer
+	for p := range pm.peers {
+		all = append(all, p)
+	}
+	pm.mutex.Unlock()
+
+	for _, p := range all {
+		select {
+		case <-p.ready:
+		case <-p.closed:
+			fmt.Printf("%s closed the connection before the handshake\n", p)
+		}
+		p.flush()
+		pm.remove(p)
+	}
+}
+
+// OutboundCount returns the number of connections this node opened
+func (pm *PeerManager) OutboundCount() int {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.count(true)
+}
+
+// count returns the number of outbound or inbound peers, the mutex must be held
+func (pm *PeerManager) count(outbound bool) int {
+	n := 0
+	for p := range pm.peers {
+		if p.Outbound == outbound {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (pm *PeerManager) remove(p *Peer) {
+	p.Close()
+
+	pm.mutex.Lock()
+	known := pm.peers[p]
+	delete(pm.peers, p)
+	if pm.byAddr[p.Addr] == p {
+		delete(pm.byAddr, p.Addr)
+	}
+	pm.mutex.Unlock()
+
+	if known && pm.OnDisconnect != nil {
+		pm.OnDisconnect(p)
+	}
+}
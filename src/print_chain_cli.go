@@ -23,6 +23,8 @@ func (cli *CLI) printChain(nodeID string) {
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Prev. block: %x\n", block.PreviousHash)
+		fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+		fmt.Printf("Height: %d, version: %d, bits: %08x\n", block.Height, block.Version, block.Bits)
 		pow := NewProofOfWork(block)
 		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
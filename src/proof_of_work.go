@@ -3,74 +3,62 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
-	"math"
 	"math/big"
+	"strconv"
 )
 
-var (
-	maxNonce = math.MaxInt64
-)
-
-const targetBits = 24
-
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
 }
 
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target := CompactToBig(b.Bits)
 
 	pow := &ProofOfWork{b, target}
 
 	return pow
 }
 
+// prepareData formats the fields blocks before headerHashVersion were hashed over
 func (pow *ProofOfWork) prepareData(nonce int) string {
 	data := fmt.Sprintf(
 		"%x%s%x%x%x",
 		pow.Block.PreviousHash,
-		pow.Block.HashTransactions(),
-		pow.Block.Timestamp,
-		targetBits,
+		pow.Block.MerkleRoot,
+		strconv.FormatInt(pow.Block.Timestamp, 10),
+		pow.Block.Bits,
 		nonce,
 	)
 
 	return data
 }
 
+// Hash recomputes the block hash from its header
+func (pow *ProofOfWork) Hash() []byte {
+	if pow.Block.Version < headerHashVersion {
+		hash := sha256.Sum256([]byte(pow.prepareData(pow.Block.Nonce)))
+		return hash[:]
+	}
+
+	return pow.Block.BlockHeader.Hash()
+}
+
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.Block.Nonce)
-	hash := sha256.Sum256([]byte(data))
-	hashInt.SetBytes(hash[:])
+	hash := pow.Hash()
+	hashInt.SetBytes(hash)
 
 	isValid := hashInt.Cmp(pow.Target) == -1
 
 	return isValid
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int
-	var hash [32]byte
-	nonce := 0
-
-	fmt.Printf("Mining a new block \n")
-	for nonce < maxNonce {
-		data := pow.prepareData(nonce)
-		hash = sha256.Sum256([]byte(data))
-		fmt.Printf("\r%x", hash)
-		hashInt.SetBytes(hash[:])
-
-		if hashInt.Cmp(pow.Target) == -1 {
-			break
-		}
-
-		nonce++
-	}
-	fmt.Print("\n\n")
+// Work returns the expected number of hashes needed to find a block at this target
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+	maxTarget := new(big.Int).Lsh(big.NewInt(1), 256)
 
-	return nonce, hash[:]
+	return maxTarget.Div(maxTarget, denominator)
 }
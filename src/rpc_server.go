@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// rpcRequest and rpcResponse follow JSON-RPC 1.0, like bitcoind
+type rpcRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     json.RawMessage   `json:"id"`
+}
+
+type rpcResponse struct {
+	Result interface{}     `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcMiscError      = -1
+)
+
+// blockTemplate describes a block for an external miner to solve. Data is the serialized
+// block, which starts with the serialized header. The nonce is the last 8 bytes of the
+// header, little-endian, and the block hash is the SHA-256 of the header.
+type blockTemplate struct {
+	Version           int                   `json:"version"`
+	PreviousBlockHash string                `json:"previousblockhash"`
+	Height            int                   `json:"height"`
+	CurTime           int64                 `json:"curtime"`
+	MinTime           int64                 `json:"mintime"`
+	Bits              string                `json:"bits"`
+	Target            string                `json:"target"`
+	CoinbaseValue     int                   `json:"coinbasevalue"`
+	CoinbaseTxn       templateTransaction   `json:"coinbasetxn"`
+	Transactions      []templateTransaction `json:"transactions"`
+	MerkleRoot        string                `json:"merkleroot"`
+	HeaderLength      int                   `json:"headerlength"`
+	Data              string                `json:"data"`
+}
+
+type templateTransaction struct {
+	Data string `json:"data"`
+	TxID string `json:"txid"`
+	Fee  int    `json:"fee"`
+}
+
+// peerInfo describes a ready peer. PingTime is the round trip time of the last ping in
+// seconds.
+type peerInfo struct {
+	Addr       string  `json:"addr"`
+	Inbound    bool    `json:"inbound"`
+	Version    int     `json:"version"`
+	Services   uint64  `json:"services"`
+	BestHeight int     `json:"bestheight"`
+	LastSeen   int64   `json:"lastseen"`
+	PingTime   float64 `json:"pingtime"`
+	InFlight   int     `json:"inflight"`
+}
+
+// StartRPCServer serves getblocktemplate, submitblock and getpeerinfo on localhost:port
+func StartRPCServer(port string, bc *Blockchain) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleRPC(w, r, bc)
+	})
+
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf("localhost:%s", port), handler)
+		if err != nil {
+			log.Panic(err)
+		}
+	}()
+}
+
+func handleRPC(w http.ResponseWriter, r *http.Request, bc *Blockchain) {
+	var request rpcRequest
+	var response rpcResponse
+
+	body := http.MaxBytesReader(w, r.Body, maxMessageSize)
+	if err := json.NewDecoder(body).Decode(&request); err != nil || r.Method != http.MethodPost {
+		response.Error = &rpcError{rpcInvalidRequest, "expected a JSON-RPC request"}
+	} else {
+		response.ID = request.ID
+		response.Result, response.Error = dispatchRPC(request, bc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Printf("RPC response failed: %s\n", err)
+	}
+}
+
+func dispatchRPC(request rpcRequest, bc *Blockchain) (interface{}, *rpcError) {
+	switch request.Method {
+	case "getblocktemplate":
+		address := miningAddress
+		if len(request.Params) > 0 {
+			if err := json.Unmarshal(request.Params[0], &address); err != nil {
+				return nil, &rpcError{rpcInvalidParams, "the parameter must be an address"}
+			}
+		}
+		if address == "" || !ValidateAddress(address) {
+			return nil, &rpcError{rpcInvalidParams, "a valid address to pay the reward to is needed"}
+		}
+
+		return getBlockTemplate(bc, address), nil
+	case "submitblock":
+		var data string
+		if len(request.Params) != 1 || json.Unmarshal(request.Params[0], &data) != nil {
+			return nil, &rpcError{rpcInvalidParams, "the parameter must be the hex-encoded block"}
+		}
+
+		return submitBlock(bc, data)
+	case "getpeerinfo":
+		return getPeerInfo(), nil
+	default:
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("unknown method %q", request.Method)}
+	}
+}
+
+// getBlockTemplate assembles a block on top of the tip paying the reward to address
+func getBlockTemplate(bc *Blockchain, address string) blockTemplate {
+	txs, fees := NewBlockAssembler(blockPolicy).Assemble(mempool)
+	lastHash, lastHeight := bc.getLastBlockHash()
+	height := lastHeight + 1
+
+	cbTx := NewCoinbaseTX(address, "", height, fees)
+	block := newUnminedBlock(append([]*Transaction{cbTx}, txs...), lastHash, height, bc.NextBits(lastHash))
+
+	minTime := bc.MedianTimePast(lastHash)
+	if block.Timestamp < minTime {
+		block.Timestamp = minTime
+	}
+
+	template := blockTemplate{
+		Version:           block.Version,
+		PreviousBlockHash: hex.EncodeToString(lastHash),
+		Height:            height,
+		CurTime:           block.Timestamp,
+		MinTime:           minTime,
+		Bits:              fmt.Sprintf("%08x", block.Bits),
+		Target:            fmt.Sprintf("%064x", CompactToBig(block.Bits)),
+		CoinbaseValue:     blockSubsidy(height) + fees,
+		CoinbaseTxn:       newTemplateTransaction(cbTx, 0),
+		MerkleRoot:        hex.EncodeToString([]byte(block.MerkleRoot)),
+		HeaderLength:      len(block.BlockHeader.Serialize()),
+		Data:              hex.EncodeToString(block.Serialize()),
+	}
+
+	for _, tx := range txs {
+		template.Transactions = append(template.Transactions, newTemplateTransaction(tx, mempool.Fee(tx.ID)))
+	}
+
+	return template
+}
+
+func newTemplateTransaction(tx *Transaction, fee int) templateTransaction {
+	return templateTransaction{hex.EncodeToString(tx.Serialize()), hex.EncodeToString([]byte(tx.ID)), fee}
+}
+
+// submitBlock validates a solved block like one received from a peer and relays it. Like
+// bitcoind it returns null on success and the reject reason otherwise.
+func submitBlock(bc *Blockchain, data string) (interface{}, *rpcError) {
+	blockData, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, "the block is not hex-encoded"}
+	}
+
+	block, err := DeserializeRelayedBlock(blockData)
+	if err != nil {
+		return nil, &rpcError{rpcMiscError, fmt.Sprintf("block decode failed: %s", err)}
+	}
+
+	err = acceptBlock(bc, block)
+	var validationErr *BlockValidationError
+	if errors.As(err, &validationErr) {
+		fmt.Printf("Rejected submitted block %x: %s\n", block.Hash, validationErr)
+		return validationErr.Reason.String(), nil
+	} else if err != nil {
+		return nil, &rpcError{rpcMiscError, err.Error()}
+	}
+
+	fmt.Printf("Added submitted block %x\n", block.Hash)
+	announceBlock(block)
+	connectOrphanBlocks(bc, block.Hash)
+
+	return nil, nil
+}
+
+func getPeerInfo() []peerInfo {
+	infos := []peerInfo{}
+	for _, p := range peers.ReadyPeers() {
+		infos = append(infos, peerInfo{
+			Addr:       p.String(),
+			Inbound:    !p.Outbound,
+			Version:    p.Version(),
+			Services:   p.Services(),
+			BestHeight: p.BestHeight(),
+			LastSeen:   p.LastSeen().Unix(),
+			PingTime:   p.Latency().Seconds(),
+			InFlight:   p.InFlight(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+
+	return infos
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
 )
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) send(from, to string, amount, fee int, nodeID string, mineNow bool) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -29,16 +30,19 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx := NewUTXOTransaction(&wallet, to, amount, fee, &UTXOSet, wallets.PendingSpends())
 
 	if mineNow {
-		cbTx := NewCoinbaseTX(from, "")
-		txs := []*Transaction{cbTx, tx}
-
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err := bc.MineBlock(context.Background(), from, []*Transaction{tx}, fee)
+		if err != nil {
+			log.Panic(err)
+		}
 	} else {
-		sendTx(knownNodes[0], tx)
+		broadcastTransaction(tx)
+
+		wallets.RecordTransaction(tx)
+		wallets.SaveToFile(nodeID)
+		fmt.Printf("Sent transaction %x\n", tx.ID)
 	}
 	fmt.Println("Success!")
 }
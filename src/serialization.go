@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Every canonically encoded object starts with this marker followed by its version.
+// gob streams never start with it, which lets the decoders recognize gob-era data.
+const serializationMarker = 0xbc
+const hashLength = 32
+
+var errNonCanonical = errors.New("non-canonical encoding")
+
+// binaryWriter builds the canonical encoding: variable-length integers, length-prefixed
+// byte strings and fixed-width hashes
+type binaryWriter struct {
+	buff bytes.Buffer
+}
+
+func newBinaryWriter(version int) *binaryWriter {
+	w := &binaryWriter{}
+	w.buff.WriteByte(serializationMarker)
+	w.writeUvarint(uint64(version))
+
+	return w
+}
+
+func (w *binaryWriter) writeUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.buff.Write(buf[:n])
+}
+
+func (w *binaryWriter) writeVarint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	w.buff.Write(buf[:n])
+}
+
+func (w *binaryWriter) writeUint32(v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	w.buff.Write(buf[:])
+}
+
+func (w *binaryWriter) writeUint64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	w.buff.Write(buf[:])
+}
+
+func (w *binaryWriter) writeBool(v bool) {
+	if v {
+		w.buff.WriteByte(1)
+	} else {
+		w.buff.WriteByte(0)
+	}
+}
+
+func (w *binaryWriter) writeBytes(data []byte) {
+	w.writeUvarint(uint64(len(data)))
+	w.buff.Write(data)
+}
+
+// writeHash writes a 32-byte hash. An empty hash, like the previous hash of the genesis
+// block or the input of a coinbase, is written as zeros.
+func (w *binaryWriter) writeHash(hash string) {
+	if len(hash) == 0 {
+		w.buff.Write(make([]byte, hashLength))
+		return
+	}
+	if len(hash) != hashLength {
+		panic(fmt.Sprintf("hash %x is not %d bytes long", hash, hashLength))
+	}
+	w.buff.WriteString(hash)
+}
+
+func (w *binaryWriter) Bytes() []byte {
+	return w.buff.Bytes()
+}
+
+// binaryReader decodes the canonical encoding. The first error sticks and every later read
+// returns zero values, so callers only check err once they are done.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// newBinaryReader checks the marker and returns a reader positioned after the version
+func newBinaryReader(data []byte) (*binaryReader, int) {
+	if !isCanonical(data) {
+		return &binaryReader{err: errors.New("missing serialization marker")}, 0
+	}
+
+	r := &binaryReader{data: data[1:]}
+	version := int(r.readUvarint())
+
+	return r, version
+}
+
+func isCanonical(data []byte) bool {
+	return len(data) > 0 && data[0] == serializationMarker
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(buf[:], v) != n {
+		r.fail(errNonCanonical)
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *binaryReader) readVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(errors.New("invalid varint"))
+		return 0
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutVarint(buf[:], v) != n {
+		r.fail(errNonCanonical)
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *binaryReader) readInt() int {
+	return int(r.readVarint())
+}
+
+func (r *binaryReader) readUint32() uint32 {
+	data := r.readFixed(4)
+	if data == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(data)
+}
+
+func (r *binaryReader) readUint64() uint64 {
+	data := r.readFixed(8)
+	if data == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(data)
+}
+
+func (r *binaryReader) readBool() bool {
+	data := r.readFixed(1)
+	if data == nil {
+		return false
+	}
+	if data[0] > 1 {
+		r.fail(errNonCanonical)
+	}
+
+	return data[0] == 1
+}
+
+// readCount reads the number of items that follow. Every item takes at least minSize
+// bytes, which bounds the count by what is left of the input.
+func (r *binaryReader) readCount(minSize int) int {
+	count := r.readUvarint()
+	if r.err == nil && count > uint64(len(r.data)/minSize) {
+		r.fail(errors.New("item count exceeds the remaining data"))
+		return 0
+	}
+
+	return int(count)
+}
+
+func (r *binaryReader) readBytes() []byte {
+	length := r.readCount(1)
+	if length == 0 {
+		return nil
+	}
+
+	return append([]byte{}, r.readFixed(length)...)
+}
+
+func (r *binaryReader) readHash() string {
+	data := r.readFixed(hashLength)
+	if data == nil || bytes.Equal(data, make([]byte, hashLength)) {
+		return ""
+	}
+
+	return string(data)
+}
+
+func (r *binaryReader) readFixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.fail(errors.New("unexpected end of data"))
+		return nil
+	}
+
+	data := r.data[:n]
+	r.data = r.data[n:]
+
+	return data
+}
+
+// finish reports the first error, or an error if any input is left over
+func (r *binaryReader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errors.New("trailing data")
+	}
+
+	return r.err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTransaction(t *testing.T) *Transaction {
+	t.Helper()
+
+	address := string(NewWallet().GetAddress())
+	tx := &Transaction{"", []TXInput{
+		{strings.Repeat("a", hashLength), 0, bytes.Repeat([]byte{1}, signatureLength), bytes.Repeat([]byte{2}, pubKeyLength)},
+		{strings.Repeat("b", hashLength), 3, bytes.Repeat([]byte{3}, signatureLength), bytes.Repeat([]byte{4}, pubKeyLength)},
+	}, []TXOutput{*NewTXOutput(7, address), *NewTXOutput(1<<40, address)}, transactionVersion}
+	tx.ID = string(tx.Hash())
+
+	return tx
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	for _, tx := range []*Transaction{testTransaction(t), NewCoinbaseTX(address, "data", 5, 3)} {
+		data := tx.Serialize()
+		decoded, err := DeserializeTransaction(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&decoded, tx) {
+			t.Errorf("decoded %v, want %v", &decoded, tx)
+		}
+		if !bytes.Equal(decoded.Serialize(), data) {
+			t.Errorf("transaction %x is encoded differently after a round trip", tx.ID)
+		}
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	txs := []*Transaction{NewCoinbaseTX(address, "", 2, 0), testTransaction(t)}
+	b := newUnminedBlock(txs, bytes.Repeat([]byte{9}, hashLength), 2, 0x1f00ffff)
+	b.Nonce = 12345
+	b.Hash = string(b.BlockHeader.Hash())
+
+	data := b.Serialize()
+	decoded, err := DeserializeRelayedBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, b) {
+		t.Errorf("decoded %+v, want %+v", decoded, b)
+	}
+	if !bytes.Equal(decoded.Serialize(), data) {
+		t.Error("the block is encoded differently after a round trip")
+	}
+}
+
+func TestOutputsRoundTrip(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	outs := NewTXOutputs()
+	outs.Height = 12
+	outs.Coinbase = true
+	outs.Outputs[0] = *NewTXOutput(5, address)
+	outs.Outputs[4] = *NewTXOutput(6, address)
+
+	data := outs.Serialize()
+	decoded, err := readOutputs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, outs) {
+		t.Errorf("decoded %+v, want %+v", decoded, outs)
+	}
+	if !bytes.Equal(decoded.Serialize(), data) {
+		t.Error("the outputs are encoded differently after a round trip")
+	}
+}
+
+func TestUndoRoundTrip(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	undo := BlockUndo{[]SpentOutput{
+		{strings.Repeat("c", hashLength), 1, *NewTXOutput(8, address), 3, true},
+		{strings.Repeat("d", hashLength), 0, *NewTXOutput(9, address), 4, false},
+	}}
+
+	data := undo.Serialize()
+	decoded, err := readBlockUndo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, undo) {
+		t.Errorf("decoded %+v, want %+v", decoded, undo)
+	}
+	if !bytes.Equal(decoded.Serialize(), data) {
+		t.Error("the undo data is encoded differently after a round trip")
+	}
+}
+
+func TestNonCanonicalVarints(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		read func(r *binaryReader)
+	}{
+		{"padded uvarint", []byte{0x81, 0x00}, func(r *binaryReader) { r.readUvarint() }},
+		{"padded zero uvarint", []byte{0x80, 0x80, 0x00}, func(r *binaryReader) { r.readUvarint() }},
+		{"padded varint", []byte{0x82, 0x00}, func(r *binaryReader) { r.readVarint() }},
+		{"padded count", []byte{0x80, 0x00}, func(r *binaryReader) { r.readBytes() }},
+	}
+
+	for _, test := range tests {
+		data := append(newBinaryWriter(1).Bytes(), test.data...)
+		r, _ := newBinaryReader(data)
+		test.read(r)
+		if r.finish() != errNonCanonical {
+			t.Errorf("%s: got %v, want %v", test.name, r.err, errNonCanonical)
+		}
+	}
+}
+
+func TestNonCanonicalVersion(t *testing.T) {
+	r, _ := newBinaryReader([]byte{serializationMarker, 0x81, 0x00})
+	if r.err != errNonCanonical {
+		t.Errorf("got %v, want %v", r.err, errNonCanonical)
+	}
+}
+
+func TestRejectedEncodings(t *testing.T) {
+	tx := testTransaction(t)
+	data := tx.Serialize()
+
+	tests := map[string][]byte{
+		"trailing data":  append(append([]byte{}, data...), 0),
+		"truncated":      data[:len(data)-1],
+		"missing marker": data[1:],
+	}
+	for name, encoded := range tests {
+		if _, err := DeserializeTransaction(encoded); err == nil {
+			t.Errorf("%s: the transaction was decoded", name)
+		}
+	}
+}
@@ -1,25 +1,48 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
-const commandLength = 12
+const nodeVersion = 4
+const minProtocolVersion = 4
+const seedNode = "localhost:3000"
+const banThreshold = 100
+const banDuration = 24 * time.Hour
+
+// connectInterval is how often the node looks for addresses to dial
+const connectInterval = time.Second
+
+// An outbound peer dropping within minStableConnection of the handshake counts as a failed
+// attempt, so a node that accepts and then drops connections is not dialed in a loop
+const minStableConnection = time.Minute
+
+// Every addrGossipInterval each peer is sent addrGossipSize addresses, this node's among them
+const addrGossipInterval = 2 * time.Minute
+const addrGossipSize = 10
+
+// maxMessageSize bounds what is read from a connection. The largest messages are blocks,
+// whose size in bytes is at most their weight, and full headers messages.
+const maxMessageSize = 2 * maxBlockWeight
 
 var nodeAddress string
 var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit [][]byte
-var mempool = make(map[string]Transaction)
+var blockPolicy = DefaultBlockPolicy()
+var peers = NewPeerManager()
+var addressBook = NewAddressBook()
+var mempool = NewMempool(maxMempoolSize, mempoolExpiry)
+var orphans = NewOrphanPool()
+var orphanBlocks = NewOrphanBlockPool()
+var headerChain *HeaderChain
+var blockDownloader *BlockDownloader
 
 type addr struct {
 	AddrList []string
@@ -30,8 +53,15 @@ type block struct {
 	Block    []byte
 }
 
-type getblocks struct {
+type getheaders struct {
+	AddrFrom string
+	Locator  [][]byte
+	StopHash []byte
+}
+
+type headers struct {
 	AddrFrom string
+	Headers  [][]byte
 }
 
 type getdata struct {
@@ -46,386 +76,654 @@ type inv struct {
 	Items    [][]byte
 }
 
+type reject struct {
+	AddrFrom string
+	Kind     string
+	Reason   RejectReason
+	ID       []byte
+	Message  string
+}
+
 type tx struct {
 	AddFrom     string
 	Transaction []byte
 }
 
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
 type verzion struct {
 	Version    int
+	Services   uint64
 	BestHeight int
+	ChainWork  []byte
 	AddrFrom   string
 }
 
-func commandToBytes(command string) []byte {
-	var bytes [commandLength]byte
-
-	for i, c := range command {
-		bytes[i] = byte(c)
-	}
+func sendAddr(p *Peer, addrs []string) {
+	payload := addr{addrs}.Serialize()
 
-	return bytes[:]
+	sendMessage(p, "addr", payload)
 }
 
-func bytesToCommand(bytes []byte) string {
-	var command []byte
+func sendGetAddr(p *Peer) {
+	p.ExpectAddrs(maxAddrPerMessage)
+	sendMessage(p, "getaddr", nil)
+}
 
-	for _, b := range bytes {
-		if b != 0x0 {
-			command = append(command, b)
-		}
+func sendMessage(p *Peer, command string, payload []byte) {
+	if err := p.Send(command, payload); err != nil {
+		fmt.Printf("Could not send %s to %s: %s\n", command, p, err)
 	}
+}
 
-	return fmt.Sprintf("%s", command)
+func sendBlock(p *Peer, b *Block) {
+	data := block{nodeAddress, b.Serialize()}
+	payload := data.Serialize()
+
+	sendMessage(p, "block", payload)
 }
 
-func extractCommand(request []byte) []byte {
-	return request[:commandLength]
+func sendInv(p *Peer, kind string, items [][]byte) {
+	inventory := inv{nodeAddress, kind, items}
+	payload := inventory.Serialize()
+
+	sendMessage(p, "inv", payload)
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
+// sendGetHeaders asks for the headers of the peer's chain that follow the header
+func sendGetHeaders(p *Peer, from string) {
+	payload := getheaders{nodeAddress, headerChain.Locator(from), nil}.Serialize()
+
+	sendMessage(p, "getheaders", payload)
+}
+
+func sendHeaders(p *Peer, blockHeaders []BlockHeader) {
+	var encoded [][]byte
+	for _, header := range blockHeaders {
+		encoded = append(encoded, header.Serialize())
 	}
+	payload := headers{nodeAddress, encoded}.Serialize()
+
+	sendMessage(p, "headers", payload)
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
+func sendGetData(p *Peer, kind string, id []byte) {
+	payload := getdata{nodeAddress, kind, id}.Serialize()
 
-	sendData(address, request)
+	p.Request(kind, id)
+	sendMessage(p, "getdata", payload)
 }
 
-func sendBlock(addr string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
+func sendReject(p *Peer, kind string, id []byte, err *BlockValidationError) {
+	payload := reject{nodeAddress, kind, err.Reason, id, err.Message}.Serialize()
 
-	sendData(addr, request)
+	sendMessage(p, "reject", payload)
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+func sendTx(p *Peer, tnx *Transaction) {
+	data := tx{nodeAddress, tnx.Serialize()}
+	payload := data.Serialize()
+
+	sendMessage(p, "tx", payload)
+}
+
+// broadcastTransaction sends a transaction made by the wallet to the seed node and waits
+// until it is written
+func broadcastTransaction(tnx *Transaction) {
+	p, err := peers.Connect(seedNode)
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+		fmt.Printf("%s is not available\n", seedNode)
+		return
+	}
+
+	sendTx(p, tnx)
+	peers.CloseAll()
+}
+
+// connectPeer opens a connection to a node of the address book, which syncs with it once
+// the handshake is done. A node that cannot be reached is dialed again after a backoff.
+func connectPeer(address string) {
+	addressBook.Attempt(address)
+	_, err := peers.Connect(address)
+	if errors.Is(err, errTooManyPeers) {
+		return
+	} else if err != nil {
+		addressBook.Failed(address)
+		fmt.Printf("%s is not available, retrying in %s\n", address, addressBook.RetryDelay(address))
+	}
+}
 
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
+// maintainConnections dials the known nodes whose backoff has passed while there are fewer
+// outbound peers than allowed, which also reconnects the peers that dropped
+func maintainConnections() {
+	for range time.Tick(connectInterval) {
+		for _, address := range addressBook.Due(time.Now()) {
+			if peers.OutboundCount() >= peers.MaxOutbound {
+				break
+			}
+			if address == nodeAddress || peers.Get(address) != nil {
+				continue
 			}
+			connectPeer(address)
 		}
+	}
+}
 
-		knownNodes = updatedNodes
-
+// handleDisconnect counts a connection that dropped before the handshake or soon after as
+// a failure of the node, so it is not dialed again right away
+func handleDisconnect(p *Peer) {
+	if !p.Outbound {
 		return
 	}
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
-			log.Panic("ERROR: error while closing database connection: ", err)
-		}
-	}(conn)
+	if !p.Ready() || time.Since(p.ReadyAt()) < minStableConnection {
+		addressBook.Failed(p.Addr)
+	} else {
+		addressBook.Stable(p.Addr)
+	}
+	if p.Ready() {
+		fmt.Printf("Disconnected from %s\n", p)
+	}
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+// handleAddr adds the addresses advertised by a peer to the address book. Beyond its rate
+// limit the addresses are ignored.
+func handleAddr(p *Peer, data []byte) error {
+	payload, err := deserializeAddr(data)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if len(payload.AddrList) > maxAddrPerMessage {
+		return fmt.Errorf("%d addresses, at most %d are allowed", len(payload.AddrList), maxAddrPerMessage)
 	}
-}
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
+	addrs := payload.AddrList
+	if allowed := p.AllowAddrs(len(addrs)); allowed < len(addrs) {
+		fmt.Printf("Ignoring %d addresses from %s over the rate limit\n", len(addrs)-allowed, p)
+		addrs = addrs[:allowed]
+	}
 
-	sendData(address, request)
+	added := 0
+	for _, address := range addrs {
+		if address != nodeAddress && addressBook.Add(address) {
+			added++
+		}
+	}
+	fmt.Printf("Received %d addresses, %d new, there are %d known nodes now\n", len(addrs), added, addressBook.Count())
+
+	return nil
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
+// handleGetAddr replies with a random sample of the address book, once per peer
+func handleGetAddr(p *Peer) {
+	if !p.AnswerGetAddr() {
+		return
+	}
 
-	sendData(address, request)
+	if addrs := addressBook.Sample(maxAddrPerMessage); len(addrs) > 0 {
+		sendAddr(p, addrs)
+	}
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-
-	sendData(address, request)
+// gossipAddresses sends each peer a few random addresses and this node's own, so nodes
+// learn about each other beyond the seed
+func gossipAddresses() {
+	for range time.Tick(addrGossipInterval) {
+		for _, p := range relayPeers() {
+			addrs := append(addressBook.Sample(addrGossipSize-1), nodeAddress)
+			sendAddr(p, addrs)
+		}
+	}
 }
 
-func sendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
+func handleBlock(p *Peer, data []byte, bc *Blockchain) error {
+	payload, err := deserializeBlockMessage(data)
+	if err != nil {
+		return err
+	}
 
-	sendData(addr, request)
-}
+	block, err := DeserializeRelayedBlock(payload.Block)
+	if err != nil {
+		return err
+	}
+	p.Received("block", []byte(block.Hash))
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
+	fmt.Println("Received a new block!")
+	if blockDownloader.Received(block, p) {
+		connectDownloadedBlocks(bc)
+		requestBlocks()
+		return nil
+	}
 
-	request := append(commandToBytes("version"), payload...)
+	err = acceptBlock(bc, block)
+	var validationErr *BlockValidationError
+	if errors.As(err, &validationErr) && validationErr.Reason == RejectUnknownParent {
+		addOrphanBlock(block, p)
+	} else if reportBlock(block, p, err) {
+		p.UpdateBestHeight(block.Height)
+		connectOrphanBlocks(bc, block.Hash)
+	}
 
-	sendData(addr, request)
+	return nil
 }
 
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
-	var payload addr
+// connectDownloadedBlocks adds the downloaded blocks that extend the chain. The header of a
+// block that turns out invalid is dropped, see invalidatesHeader.
+func connectDownloadedBlocks(bc *Blockchain) {
+	blockDownloader.Connect(func(block *Block, peer *Peer) {
+		err := acceptBlock(bc, block)
+		if reportBlock(block, peer, err) {
+			connectOrphanBlocks(bc, block.Hash)
+		} else if invalidatesHeader(block, err) {
+			headerChain.Invalidate(block.Hash)
+		}
+	})
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+// invalidatesHeader reports whether a downloaded block was refused for what its header
+// commits to. A peer may send a block that does not match its hash or other transactions
+// than the Merkle root commits to, which says nothing about the header.
+func invalidatesHeader(block *Block, err error) bool {
+	validationErr, ok := err.(*BlockValidationError)
+	if !ok {
+		return false
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
-}
+	switch validationErr.Reason {
+	case RejectDuplicate, RejectHighHash, RejectBadMerkleRoot, RejectBadHeight:
+		return false
+	}
 
-func handleBlock(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload block
+	return checkMerkleRoot(block) == nil
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+// requestBlocks asks the peers for the missing blocks of the best header chain
+func requestBlocks() {
+	for _, request := range blockDownloader.Schedule(relayPeers()) {
+		sendGetData(request.Peer, "block", request.Hash)
 	}
+}
 
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+// downloadBlocks moves the requests of peers that left or stalled to other peers
+func downloadBlocks() {
+	for range time.Tick(blockDownloadInterval) {
+		requestBlocks()
+	}
+}
 
-	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
+// reportBlock logs the outcome of adding a block from peer, rejecting invalid blocks and
+// penalizing the peer for them. It reports whether the block was added.
+func reportBlock(block *Block, peer *Peer, err error) bool {
+	if validationErr, ok := err.(*BlockValidationError); ok {
+		if validationErr.Reason != RejectDuplicate {
+			fmt.Printf("Rejected block %x: %s\n", block.Hash, validationErr)
+			if !peer.Closed() {
+				sendReject(peer, "block", []byte(block.Hash), validationErr)
+			}
+			misbehaving(peer, rejectPenalty(validationErr.Reason))
+		}
+		return false
+	} else if err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	return true
+}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+// addOrphanBlock keeps a block whose parent is unknown and asks the peer for the first
+// ancestor missing from the orphan pool. Blocks too easy to mine are rejected.
+func addOrphanBlock(block *Block, peer *Peer) {
+	if err := checkOrphanDifficulty(block, headerChain.Best()); err != nil {
+		reportBlock(block, peer, err)
+		return
 	}
+	if !orphanBlocks.Add(block, peer) {
+		return
+	}
+
+	missing := orphanBlocks.MissingAncestor(block.Hash)
+	fmt.Printf("Block %x is an orphan, requesting ancestor %x\n", block.Hash, missing)
+	sendGetData(peer, "block", []byte(missing))
 }
 
-func handleInv(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload inv
+// connectOrphanBlocks adds the orphans descending from a newly added block, parents first
+func connectOrphanBlocks(bc *Blockchain, parent string) {
+	parents := []string{parent}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	for len(parents) > 0 {
+		for _, orphan := range orphanBlocks.TakeChildren(parents[0]) {
+			if reportBlock(orphan.Block, orphan.Peer, acceptBlock(bc, orphan.Block)) {
+				parents = append(parents, orphan.Block.Hash)
+			}
+		}
+		parents = parents[1:]
+	}
+}
+
+func handleInv(p *Peer, data []byte, bc *Blockchain) error {
+	payload, err := deserializeInv(data)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-
-		var newInTransit [][]byte
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		// the headers of announced blocks are checked before the blocks are downloaded
+		for _, hash := range payload.Items {
+			if !bc.HasBlock(hash) && !orphanBlocks.Has(string(hash)) {
+				sendGetHeaders(p, headerChain.Best().Hash)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
-
-		if mempool[hex.EncodeToString(txID)].ID == "" {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		for _, txID := range payload.Items {
+			if !mempool.Has(string(txID)) && !orphans.Has(string(txID)) && !peers.Requested("tx", txID) {
+				sendGetData(p, "tx", txID)
+			}
 		}
 	}
-}
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload getblocks
+	return nil
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+func handleGetHeaders(p *Peer, data []byte, bc *Blockchain) error {
+	payload, err := deserializeGetHeaders(data)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	if len(payload.Locator) > maxLocatorLength {
+		return fmt.Errorf("the locator has %d hashes, more than %d", len(payload.Locator), maxLocatorLength)
+	}
+
+	sendHeaders(p, bc.LocateHeaders(payload.Locator, payload.StopHash, maxHeadersPerMessage))
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload getdata
+// handleHeaders adds the headers to the header chain, asks for more when the message is
+// full and downloads the blocks of a better chain
+func handleHeaders(p *Peer, data []byte) error {
+	payload, err := deserializeHeaders(data)
+	if err != nil {
+		return err
+	}
+	if len(payload.Headers) > maxHeadersPerMessage {
+		return fmt.Errorf("%d headers, more than %d", len(payload.Headers), maxHeadersPerMessage)
+	}
+
+	var received []BlockHeader
+	for _, encoded := range payload.Headers {
+		header, err := DeserializeBlockHeader(encoded)
+		if err != nil {
+			return err
+		}
+		if err := checkRelayedVersion(header.Version); err != nil {
+			return err
+		}
+		received = append(received, header)
+	}
+	fmt.Printf("Received %d headers\n", len(received))
+	if len(received) == 0 {
+		return nil
+	}
+
+	last, err := headerChain.Add(received)
+	var validationErr *BlockValidationError
+	if errors.As(err, &validationErr) && validationErr.Reason == RejectUnknownParent {
+		// the locator sent last is out of date, a peer answering a current one connects
+		misbehaving(p, 10)
+		sendGetHeaders(p, headerChain.Best().Hash)
+		return nil
+	} else if errors.As(err, &validationErr) {
+		fmt.Printf("Rejected headers from %s: %s\n", p, validationErr)
+		misbehaving(p, rejectPenalty(validationErr.Reason))
+		return nil
+	}
+
+	p.UpdateBestHeight(last.Height)
+	if len(received) == maxHeadersPerMessage {
+		sendGetHeaders(p, last.Hash)
+	}
+	requestBlocks()
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	return nil
+}
+
+func handleGetData(p *Peer, data []byte, bc *Blockchain) error {
+	payload, err := deserializeGetData(data)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	if payload.Type == "block" {
 		block, err := bc.GetBlock(payload.ID)
 		if err != nil {
-			return
+			return nil
 		}
 
-		sendBlock(payload.AddrFrom, &block)
+		sendBlock(p, &block)
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := mempool.Get(string(payload.ID))
+		if !ok {
+			return nil
+		}
 
-		sendTx(payload.AddrFrom, &tx)
+		sendTx(p, tx)
 	}
-}
 
-func handleTx(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload tx
+	return nil
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+func handleReject(data []byte) error {
+	payload, err := deserializeReject(data)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[tx.ID] = tx
+	fmt.Printf("%s rejected %s %x: %s: %s\n", payload.AddrFrom, payload.Kind, payload.ID, payload.Reason, payload.Message)
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{[]byte(tx.ID)})
-			}
-		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+	return nil
+}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+func handleTx(p *Peer, data []byte, bc *Blockchain) error {
+	payload, err := deserializeTxMessage(data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		return err
+	}
+	p.Received("tx", []byte(tx.ID))
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+	acceptTransaction(bc, &tx, p)
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+	return nil
+}
 
-			fmt.Println("New block is mined!")
+// acceptTransaction adds a transaction received from a peer to the mempool, or to the
+// orphan pool while its parents are missing, in which case they are requested from the peer
+func acceptTransaction(bc *Blockchain, tx *Transaction, from *Peer) {
+	err := mempool.Add(tx, bc)
+	var missing *MissingParentsError
+	if errors.As(err, &missing) {
+		if err := orphans.Add(tx, from.Addr, missing.Parents); err != nil {
+			fmt.Printf("Dropped orphan transaction %x: %s\n", tx.ID, err)
+			return
+		}
 
-			for _, tx := range txs {
-				delete(mempool, tx.ID)
+		fmt.Printf("Transaction %x is an orphan, requesting %d parents\n", tx.ID, len(missing.Parents))
+		for _, parent := range missing.Parents {
+			if !orphans.Has(parent) {
+				sendGetData(from, "tx", []byte(parent))
 			}
+		}
+		return
+	} else if err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return
+	}
+
+	relayTransaction(tx, from.Addr)
+	processOrphans(bc, tx.ID)
+}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{[]byte(newBlock.Hash)})
-				}
+// processOrphans moves the orphans waiting for a new transaction to the mempool, followed
+// by the orphans waiting for them in turn
+func processOrphans(bc *Blockchain, parent string) {
+	parents := []string{parent}
+
+	for len(parents) > 0 {
+		for _, orphan := range orphans.Children(parents[0]) {
+			err := mempool.Add(orphan.Tx, bc)
+			var missing *MissingParentsError
+			if errors.As(err, &missing) {
+				continue
 			}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
+			orphans.Remove(orphan.Tx.ID)
+			if err != nil {
+				fmt.Printf("Dropped orphan transaction %x: %s\n", orphan.Tx.ID, err)
+				continue
 			}
+
+			fmt.Printf("Accepted orphan transaction %x\n", orphan.Tx.ID)
+			relayTransaction(orphan.Tx, orphan.Peer)
+			parents = append(parents, orphan.Tx.ID)
 		}
+		parents = parents[1:]
 	}
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload verzion
+// relayTransaction announces a new mempool transaction to the other nodes and wakes the
+// miner up
+func relayTransaction(tx *Transaction, from string) {
+	for _, p := range relayPeers() {
+		if p.Addr != from {
+			sendInv(p, "tx", [][]byte{[]byte(tx.ID)})
+		}
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	select {
+	case newTransactions <- struct{}{}:
+	default:
+	}
+}
+
+// acceptBlock adds a block received from a peer or a miner to the chain and updates the
+// mempool: the block's transactions and their conflicts leave, transactions of
+// disconnected blocks go back in and the ones the new tip made invalid are dropped. Orphans
+// spending the block's outputs are retried.
+func acceptBlock(bc *Blockchain, block *Block) error {
+	readmitted, err := bc.AddBlock(block)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	mempool.RemoveForBlock(block)
+	mempool.Readmit(readmitted, bc)
+	mempool.Revalidate(bc)
+
+	orphans.RemoveForBlock(block)
+	for _, tx := range block.Transactions {
+		processOrphans(bc, tx.ID)
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	return nil
+}
 
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+func announceBlock(block *Block) {
+	for _, p := range relayPeers() {
+		sendInv(p, "block", [][]byte{[]byte(block.Hash)})
 	}
+}
 
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+// relayPeers returns the nodes that completed the handshake and take part in the relay
+func relayPeers() []*Peer {
+	var relay []*Peer
+	for _, p := range peers.ReadyPeers() {
+		if p.Services()&serviceNetwork != 0 {
+			relay = append(relay, p)
+		}
 	}
+
+	return relay
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
-	if err != nil {
-		log.Panic(err)
+// handleReady syncs with a node that completed the handshake and has more work
+func handleReady(p *Peer, bc *Blockchain) {
+	if p.Services()&serviceNetwork == 0 {
+		return
+	}
+	fmt.Printf("Connected to %s, protocol version %d, best height %d\n", p, p.Version(), p.BestHeight())
+
+	if p.Outbound {
+		addressBook.Connected(p.Addr)
+		sendGetAddr(p)
+	} else if p.Addr != "" {
+		addressBook.Add(p.Addr)
+	}
+	if bc.GetBestChainWork().Cmp(p.ChainWork()) < 0 {
+		sendGetHeaders(p, headerChain.Best().Hash)
+	}
+}
+
+// handleMessage runs the handler of a command received from a peer. A peer sending a
+// message that cannot be decoded is disconnected.
+func handleMessage(p *Peer, command string, payload []byte, bc *Blockchain) {
+	if peers.Banned(p) {
+		p.Close()
+		return
 	}
-	command := bytesToCommand(request[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
+	var err error
 	switch command {
 	case "addr":
-		handleAddr(request)
+		err = handleAddr(p, payload)
 	case "block":
-		handleBlock(request, bc)
+		err = handleBlock(p, payload, bc)
 	case "inv":
-		handleInv(request, bc)
-	case "getblocks":
-		handleGetBlocks(request, bc)
+		err = handleInv(p, payload, bc)
+	case "getaddr":
+		handleGetAddr(p)
+	case "getheaders":
+		err = handleGetHeaders(p, payload, bc)
+	case "headers":
+		err = handleHeaders(p, payload)
 	case "getdata":
-		handleGetData(request, bc)
+		err = handleGetData(p, payload, bc)
+	case "reject":
+		err = handleReject(payload)
 	case "tx":
-		handleTx(request, bc)
-	case "version":
-		handleVersion(request, bc)
+		err = handleTx(p, payload, bc)
 	default:
 		fmt.Println("Unknown command!")
 	}
 
-	err = conn.Close()
 	if err != nil {
-		log.Panic(err)
-		return
+		fmt.Printf("Disconnecting %s: bad %s message: %s\n", p, command, err)
+		p.Close()
 	}
 }
 
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID string, miner MinerConfig, rpcPort string) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
+	miningAddress = miner.Address
+	blockPolicy = miner.Policy
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
 		log.Panic(err)
@@ -438,38 +736,103 @@ func StartServer(nodeID, minerAddress string) {
 	}(ln)
 
 	bc := NewBlockchain(nodeID)
+	headerChain = NewHeaderChain(bc)
+	blockDownloader = NewBlockDownloader(headerChain, bc)
+	peers.LocalVersion = func() verzion {
+		return verzion{nodeVersion, serviceNetwork, bc.GetBestHeight(), bc.GetBestChainWork().Bytes(), nodeAddress}
+	}
+	peers.Handle = func(p *Peer, command string, payload []byte) {
+		handleMessage(p, command, payload, bc)
+	}
+	peers.OnReady = func(p *Peer) {
+		handleReady(p, bc)
+	}
+	peers.OnDisconnect = handleDisconnect
+
+	mempoolPath := fmt.Sprintf(mempoolFile, nodeID)
+	if loaded, err := mempool.Load(mempoolPath, bc); err != nil {
+		fmt.Printf("Could not load %s: %s\n", mempoolPath, err)
+	} else if loaded > 0 {
+		fmt.Printf("Loaded %d transactions into the mempool\n", loaded)
+	}
+	peersPath := fmt.Sprintf(peersFile, nodeID)
+	if loaded, err := addressBook.Load(peersPath); err != nil {
+		fmt.Printf("Could not load %s: %s\n", peersPath, err)
+	} else if loaded > 0 {
+		fmt.Printf("Loaded %d node addresses\n", loaded)
+	}
+	// the seed stays known whatever the saved addresses are
+	if nodeAddress != seedNode {
+		addressBook.Add(seedNode)
+	}
+	go shutdownOnSignal(bc, mempoolPath, peersPath)
+
+	if rpcPort != "" {
+		StartRPCServer(rpcPort, bc)
+	}
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	if len(miningAddress) > 0 {
+		go mineBlocks(bc, miner)
 	}
+	go downloadBlocks()
+	go maintainConnections()
+	go gossipAddresses()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Panic(err)
 		}
-		go handleConnection(conn, bc)
+		go peers.Serve(conn)
 	}
 }
 
-func gobEncode(data interface{}) []byte {
-	var buff bytes.Buffer
+// shutdownOnSignal saves the mempool and the address book and closes the database when the
+// node is interrupted
+func shutdownOnSignal(bc *Blockchain, mempoolPath string, peersPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
 
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(data)
-	if err != nil {
+	fmt.Println("Shutting down")
+	if err := mempool.Save(mempoolPath); err != nil {
+		fmt.Printf("Could not save the mempool: %s\n", err)
+	} else {
+		fmt.Printf("Saved %d transactions to %s\n", mempool.Count(), mempoolPath)
+	}
+	if err := addressBook.Save(peersPath); err != nil {
+		fmt.Printf("Could not save the address book: %s\n", err)
+	} else {
+		fmt.Printf("Saved %d node addresses, %d tried, to %s\n", addressBook.Count(), addressBook.TriedCount(), peersPath)
+	}
+
+	if err := bc.DB.Close(); err != nil {
 		log.Panic(err)
 	}
+	os.Exit(0)
+}
 
-	return buff.Bytes()
+// rejectPenalty scores how badly a peer misbehaved by relaying a block refused for the reason
+func rejectPenalty(reason RejectReason) int {
+	switch reason {
+	case RejectDuplicate, RejectUnknownParent:
+		return 0
+	case RejectBadTimestamp:
+		return 10
+	default:
+		return banThreshold
+	}
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
-		}
+// misbehaving adds to the peer's misbehavior score and bans it once the threshold is reached
+func misbehaving(p *Peer, score int) {
+	if !peers.Misbehaving(p, score) {
+		return
 	}
 
-	return false
+	fmt.Printf("Banning %s for misbehavior for %s\n", banKey(p.Connection), banDuration)
+	// only the address this node dialed is known to belong to the peer
+	if p.Outbound {
+		addressBook.Remove(p.Addr)
+	}
 }
@@ -5,14 +5,17 @@ import (
 	"log"
 )
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID string, miner MinerConfig, rpcPort string) {
 	fmt.Printf("Starting node %s\n", nodeID)
-	if len(minerAddress) > 0 {
-		if ValidateAddress(minerAddress) {
-			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+	if len(miner.Address) > 0 {
+		if ValidateAddress(miner.Address) {
+			fmt.Println("Mining is on. Address to receive rewards: ", miner.Address)
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	if len(rpcPort) > 0 {
+		fmt.Printf("Serving getblocktemplate, submitblock and getpeerinfo on localhost:%s\n", rpcPort)
+	}
+	StartServer(nodeID, miner, rpcPort)
 }
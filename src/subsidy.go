@@ -0,0 +1,43 @@
+package main
+
+// blockSubsidy returns the newly minted coins a block at the given height may claim.
+// The reward starts at InitialSubsidy and halves every HalvingInterval blocks.
+func blockSubsidy(height int) int {
+	halvings := height / chainParams.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return chainParams.InitialSubsidy >> uint(halvings)
+}
+
+// totalSubsidy returns the coins minted by the blocks up to and including the given height
+func totalSubsidy(height int) int {
+	total := 0
+
+	for start := 0; start <= height; start += chainParams.HalvingInterval {
+		reward := blockSubsidy(start)
+		if reward == 0 {
+			break
+		}
+
+		blocks := chainParams.HalvingInterval
+		if start+blocks > height+1 {
+			blocks = height + 1 - start
+		}
+		total += reward * blocks
+	}
+
+	return total
+}
+
+// maxSupply returns the number of coins that will ever be minted
+func maxSupply() int {
+	total := 0
+
+	for reward := chainParams.InitialSubsidy; reward > 0; reward >>= 1 {
+		total += reward * chainParams.HalvingInterval
+	}
+
+	return total
+}
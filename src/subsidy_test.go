@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func setSubsidyParams(t *testing.T, initial, halvingInterval int) {
+	params := chainParams
+	t.Cleanup(func() { chainParams = params })
+
+	chainParams.InitialSubsidy = initial
+	chainParams.HalvingInterval = halvingInterval
+}
+
+func TestBlockSubsidy(t *testing.T) {
+	setSubsidyParams(t, 50, 10)
+
+	tests := []struct {
+		height int
+		want   int
+	}{
+		{0, 50},
+		{9, 50},
+		{10, 25},
+		{19, 25},
+		{20, 12},
+		{30, 6},
+		{50, 1},
+		{59, 1},
+		{60, 0},
+		{63 * 10, 0},
+		{1 << 40, 0},
+	}
+
+	for _, test := range tests {
+		if got := blockSubsidy(test.height); got != test.want {
+			t.Errorf("blockSubsidy(%d) = %d, want %d", test.height, got, test.want)
+		}
+	}
+}
+
+func TestTotalSubsidy(t *testing.T) {
+	for _, params := range [][2]int{{50, 10}, {10, 210}, {7, 1}, {1, 3}} {
+		setSubsidyParams(t, params[0], params[1])
+
+		sum := 0
+		for height := 0; height < 80*params[1]; height++ {
+			sum += blockSubsidy(height)
+			if got := totalSubsidy(height); got != sum {
+				t.Fatalf("params %v: totalSubsidy(%d) = %d, want %d", params, height, got, sum)
+			}
+		}
+		if sum != maxSupply() {
+			t.Errorf("params %v: the subsidies add up to %d, maxSupply is %d", params, sum, maxSupply())
+		}
+	}
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -14,32 +12,29 @@ import (
 	"strings"
 )
 
-const subsidy = 10
+const transactionVersion = 1
+
+// Sizes of the fixed-width public keys and signatures: two P-256 coordinates or the r and
+// s values, each padded to 32 bytes
+const coordinateLength = 32
+const pubKeyLength = 2 * coordinateLength
+const signatureLength = 2 * coordinateLength
 
 type Transaction struct {
 	ID   string
 	Vin  []TXInput
 	Vout []TXOutput
-}
-
-func (tx *Transaction) SetID() {
-	var encoded bytes.Buffer
-	var hash [32]byte
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
-	}
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = string(hash[:])
+	version int
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].TxID) == 0 && tx.Vin[0].Vout == -1
 }
 
-func NewCoinbaseTX(to, data string) *Transaction {
+// NewCoinbaseTX creates the transaction paying the subsidy of a block at the given height
+// plus the fees of the block's transactions
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 20)
 		_, err := rand.Read(randData)
@@ -51,28 +46,31 @@ func NewCoinbaseTX(to, data string) *Transaction {
 	}
 
 	txin := TXInput{"", -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{"", []TXInput{txin}, []TXOutput{*txout}}
+	txout := NewTXOutput(blockSubsidy(height)+fees, to)
+	tx := Transaction{"", []TXInput{txin}, []TXOutput{*txout}, transactionVersion}
 	tx.ID = string(tx.Hash())
 
 	return &tx
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction creates a transaction sending amount to the address. The fee is
+// left to the miner as the difference between the inputs and the outputs. The pending
+// outputs, already spent by unconfirmed transactions, are not spent again.
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet, pending map[Outpoint]bool) *Transaction {
 	pubKeyHash := HashPubKey(wallet.PublicKey)
 
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee, pending)
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
 	from := fmt.Sprintf("%s", wallet.GetAddress())
 	inputs := createInputs(validOutputs, wallet.PublicKey)
-	outputs := createOutputs(amount, acc, from, to)
+	outputs := createOutputs(amount, acc-fee, from, to)
 
-	tx := &Transaction{"", inputs, outputs}
-	tx.ID = string(tx.Hash())
+	tx := &Transaction{"", inputs, outputs, transactionVersion}
 	UTXOSet.Blockchain.SignTransaction(tx, wallet.PrivateKey)
+	tx.ID = string(tx.Hash())
 
 	return tx
 }
@@ -95,7 +93,7 @@ func createInputs(validOutputs map[string][]int, pubKey []byte) []TXInput {
 
 func createOutputs(amount, acc int, from, to string) []TXOutput {
 	outputs := []TXOutput{
-		{amount, []byte(to)},
+		*NewTXOutput(amount, to),
 	}
 
 	if acc > amount {
@@ -129,7 +127,9 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Tran
 		if err != nil {
 			log.Panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		signature := make([]byte, signatureLength)
+		r.FillBytes(signature[:coordinateLength])
+		s.FillBytes(signature[coordinateLength:])
 
 		tx.Vin[inID].Signature = signature
 	}
@@ -147,7 +147,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.version}
 
 	return txCopy
 }
@@ -157,19 +157,34 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		return true
 	}
 
+	var spent []TXOutput
 	for _, vin := range tx.Vin {
-		if prevTXs[vin.TxID].ID == "nil" {
-			log.Panic("ERROR: Previous transaction is not correct")
+		prevTx, ok := prevTXs[vin.TxID]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return false
 		}
+		spent = append(spent, prevTx.Vout[vin.Vout])
+	}
+
+	return tx.VerifyInputs(spent)
+}
+
+// VerifyInputs checks the input signatures against the outputs they spend, given in input order
+func (tx *Transaction) VerifyInputs(spent []TXOutput) bool {
+	if len(spent) != len(tx.Vin) {
+		return false
 	}
 
 	txCopy := tx.TrimmedCopy()
 	curve := elliptic.P256()
 
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[vin.TxID]
+		if len(vin.Signature) == 0 || len(vin.PubKey) == 0 || !vin.UsesKey(spent[inID].PubKeyHash) {
+			return false
+		}
+
 		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		txCopy.Vin[inID].PubKey = spent[inID].PubKeyHash
 		txCopy.ID = string(txCopy.Hash())
 		txCopy.Vin[inID].PubKey = nil
 
@@ -194,37 +209,86 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	return true
 }
 
+// Serialize returns the canonical encoding of the transaction. The ID is left out, it is
+// the hash of the encoding.
 func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	w := newBinaryWriter(tx.version)
+	tx.write(w)
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+	return w.Bytes()
+}
+
+func (tx *Transaction) write(w *binaryWriter) {
+	w.writeUvarint(uint64(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		w.writeHash(vin.TxID)
+		w.writeVarint(int64(vin.Vout))
+		w.writeBytes(vin.Signature)
+		w.writeBytes(vin.PubKey)
+	}
+
+	w.writeUvarint(uint64(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		w.writeVarint(int64(vout.Value))
+		w.writeBytes(vout.PubKeyHash)
+	}
+}
+
+// DeserializeTransaction decodes a transaction in the canonical encoding, or a version 0
+// transaction encoded with gob
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	var transaction *Transaction
+	var err error
+
+	if isCanonical(data) {
+		r, version := newBinaryReader(data)
+		transaction = readTransaction(r, version)
+		err = r.finish()
+	} else {
+		transaction, err = decodeLegacyTransaction(data)
+	}
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, err
 	}
-	hash := sha256.Sum256(encoded.Bytes())
-	tx.ID = string(hash[:])
 
-	return encoded.Bytes()
+	return *transaction, nil
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
+func readTransaction(r *binaryReader, version int) *Transaction {
+	tx := &Transaction{version: version}
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	if err != nil {
-		log.Panic(err)
+	for i, n := 0, r.readCount(hashLength+3); i < n; i++ {
+		var vin TXInput
+		vin.TxID = r.readHash()
+		vin.Vout = r.readInt()
+		vin.Signature = r.readBytes()
+		vin.PubKey = r.readBytes()
+		tx.Vin = append(tx.Vin, vin)
+	}
+
+	for i, n := 0, r.readCount(2); i < n; i++ {
+		var vout TXOutput
+		vout.Value = r.readInt()
+		vout.PubKeyHash = r.readBytes()
+		tx.Vout = append(tx.Vout, vout)
 	}
 
-	return transaction
+	tx.ID = string(tx.Hash())
+
+	return tx
 }
 
 func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.ID = ""
 
-	hash := sha256.Sum256(txCopy.Serialize())
+	var encoded []byte
+	if tx.version == legacyVersion {
+		encoded = txCopy.legacySerialize()
+	} else {
+		encoded = txCopy.Serialize()
+	}
+	hash := sha256.Sum256(encoded)
 
 	return hash[:]
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"errors"
 	"log"
+	"sort"
 )
 
+const outputsVersion = 1
+
 type TXOutput struct {
 	Value      int
 	PubKeyHash []byte
@@ -27,30 +30,78 @@ func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
+// TXOutputs holds the unspent outputs of a transaction keyed by their original index,
+// along with the height of the block that created them
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs  map[int]TXOutput
+	Height   int
+	Coinbase bool
+}
+
+func NewTXOutputs() TXOutputs {
+	return TXOutputs{make(map[int]TXOutput), 0, false}
+}
+
+// IsMature reports whether the outputs may be spent by a block at the given height.
+// Coinbase outputs have to wait CoinbaseMaturity blocks.
+func (outs TXOutputs) IsMature(height int) bool {
+	return !outs.Coinbase || height-outs.Height >= chainParams.CoinbaseMaturity
 }
 
+// Serialize returns the canonical encoding of the outputs, written in index order
 func (outs TXOutputs) Serialize() []byte {
-	var buff bytes.Buffer
+	w := newBinaryWriter(outputsVersion)
 
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
-	if err != nil {
-		log.Panic("ERROR: error while encoding: ", err)
+	w.writeVarint(int64(outs.Height))
+	w.writeBool(outs.Coinbase)
+
+	var indexes []int
+	for outIdx := range outs.Outputs {
+		indexes = append(indexes, outIdx)
+	}
+	sort.Ints(indexes)
+
+	w.writeUvarint(uint64(len(indexes)))
+	for _, outIdx := range indexes {
+		w.writeUvarint(uint64(outIdx))
+		w.writeVarint(int64(outs.Outputs[outIdx].Value))
+		w.writeBytes(outs.Outputs[outIdx].PubKeyHash)
 	}
 
-	return buff.Bytes()
+	return w.Bytes()
 }
 
+// DeserializeOutputs decodes outputs in the canonical encoding. A UTXO set stored with gob
+// is rebuilt by migratedb.
 func DeserializeOutputs(data []byte) TXOutputs {
-	var outputs TXOutputs
-
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outputs)
+	outputs, err := readOutputs(data)
 	if err != nil {
 		log.Panic("ERROR: error while decoding: ", err)
 	}
 
 	return outputs
 }
+
+func readOutputs(data []byte) (TXOutputs, error) {
+	r, _ := newBinaryReader(data)
+	outputs := NewTXOutputs()
+
+	outputs.Height = r.readInt()
+	outputs.Coinbase = r.readBool()
+
+	previous := -1
+	for i, n := 0, r.readCount(3); i < n; i++ {
+		outIdx := int(r.readUvarint())
+		if r.err == nil && outIdx <= previous {
+			r.fail(errors.New("outputs are not in index order"))
+		}
+		previous = outIdx
+
+		var out TXOutput
+		out.Value = r.readInt()
+		out.PubKeyHash = r.readBytes()
+		outputs.Outputs[outIdx] = out
+	}
+
+	return outputs, r.finish()
+}
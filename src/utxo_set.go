@@ -12,9 +12,10 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int, pending map[Outpoint]bool) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
+	nextHeight := u.Blockchain.GetBestHeight() + 1
 
 	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
@@ -23,8 +24,14 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
+			if !outs.IsMature(nextHeight) {
+				continue
+			}
 
 			for outIdx, out := range outs.Outputs {
+				if pending[Outpoint{string(k), outIdx}] {
+					continue
+				}
 				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
 					accumulated += out.Value
 					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
@@ -67,6 +74,64 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// FindBalance returns the value locked with the key that can be spent in the next block
+// and the value of coinbase outputs that have not matured yet
+func (u UTXOSet) FindBalance(pubKeyHash []byte) (int, int) {
+	spendable, immature := 0, 0
+	nextHeight := u.Blockchain.GetBestHeight() + 1
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for _, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+
+				if outs.IsMature(nextHeight) {
+					spendable += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return spendable, immature
+}
+
+// TotalValue sums up all unspent outputs
+func (u UTXOSet) TotalValue() int {
+	total := 0
+
+	err := u.Blockchain.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			for _, out := range DeserializeOutputs(v).Outputs {
+				total += out.Value
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return total
+}
+
 func (u UTXOSet) CountTransactions() int {
 	counter := 0
 
@@ -113,12 +178,7 @@ func (u UTXOSet) Reindex() {
 		b := tx.Bucket(bucketName)
 
 		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panic(err)
-			}
-
-			err = b.Put(key, outs.Serialize())
+			err := b.Put([]byte(txID), outs.Serialize())
 			if err != nil {
 				log.Panic(err)
 			}
@@ -126,53 +186,136 @@ func (u UTXOSet) Reindex() {
 
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
 func (u UTXOSet) Update(block *Block) {
 	err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+		u.connect(tx, block)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get([]byte(vin.TxID))
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+// Disconnect restores the UTXO set to the state before the block was connected
+func (u UTXOSet) Disconnect(block *Block) {
+	err := u.Blockchain.DB.Update(func(tx *bolt.Tx) error {
+		u.disconnect(tx, block)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete([]byte(vin.TxID))
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put([]byte(vin.TxID), updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
+// connect removes the outputs spent by the block, adds the ones it creates and
+// stores the spent outputs as the block's undo data
+func (u UTXOSet) connect(tx *bolt.Tx, block *Block) {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := BlockUndo{}
+
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() == false {
+			for _, vin := range transaction.Vin {
+				outsBytes := b.Get([]byte(vin.TxID))
+				if outsBytes == nil {
+					log.Panicf("ERROR: output %x:%d is not in the UTXO set", vin.TxID, vin.Vout)
+				}
+				outs := DeserializeOutputs(outsBytes)
 
+				out, ok := outs.Outputs[vin.Vout]
+				if !ok {
+					log.Panicf("ERROR: output %x:%d is not in the UTXO set", vin.TxID, vin.Vout)
 				}
-			}
+				undo.Spent = append(undo.Spent, SpentOutput{vin.TxID, vin.Vout, out, outs.Height, outs.Coinbase})
+				delete(outs.Outputs, vin.Vout)
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				if len(outs.Outputs) == 0 {
+					err := b.Delete([]byte(vin.TxID))
+					if err != nil {
+						log.Panic(err)
+					}
+				} else {
+					err := b.Put([]byte(vin.TxID), outs.Serialize())
+					if err != nil {
+						log.Panic(err)
+					}
+				}
 			}
+		}
 
-			err := b.Put([]byte(tx.ID), newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
+		newOutputs := NewTXOutputs()
+		newOutputs.Height = block.Height
+		newOutputs.Coinbase = transaction.IsCoinbase()
+		for outIdx, out := range transaction.Vout {
+			newOutputs.Outputs[outIdx] = out
 		}
 
-		return nil
-	})
+		err := b.Put([]byte(transaction.ID), newOutputs.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	undos, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := undos.Put([]byte(block.Hash), undo.Serialize()); err != nil {
+		log.Panic(err)
+	}
+}
+
+// disconnect reverts connect using the block's undo data: the outputs created by
+// the block are removed and the outputs it spent are put back at their original indexes
+func (u UTXOSet) disconnect(tx *bolt.Tx, block *Block) {
+	b := tx.Bucket([]byte(utxoBucket))
+	created := make(map[string]bool)
+
+	undos := tx.Bucket([]byte(undoBucket))
+	var undoData []byte
+	if undos != nil {
+		undoData = undos.Get([]byte(block.Hash))
+	}
+	if undoData == nil {
+		log.Panicf("ERROR: no undo data for block %x", block.Hash)
+	}
+	undo := DeserializeBlockUndo(undoData)
+
+	for _, transaction := range block.Transactions {
+		created[transaction.ID] = true
+
+		err := b.Delete([]byte(transaction.ID))
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		if created[spent.TxID] {
+			continue
+		}
+
+		outs := NewTXOutputs()
+		if outsBytes := b.Get([]byte(spent.TxID)); outsBytes != nil {
+			outs = DeserializeOutputs(outsBytes)
+		}
+		outs.Outputs[spent.Index] = spent.Output
+		outs.Height = spent.Height
+		outs.Coinbase = spent.Coinbase
+
+		err := b.Put([]byte(spent.TxID), outs.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	err := undos.Delete([]byte(block.Hash))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDisconnectRestoresUTXOSet(t *testing.T) {
+	bc, wallet := testChain(t)
+	utxoSet := UTXOSet{bc}
+	coinbase := testMine(t, bc, wallet).Transactions[0]
+	value := coinbase.Vout[0].Value
+
+	split := testSpend(wallet, coinbase, 0, value/2, value-value/2)
+	testMine(t, bc, wallet, split)
+	before := utxoSnapshot(t, bc)
+
+	// the block spends one of the two outputs of a transaction and an output it creates
+	// itself
+	spend := testSpend(wallet, split, 1, value-value/2)
+	child := testSpend(wallet, spend, 0, value-value/2)
+	block := testMine(t, bc, wallet, spend, child)
+	after := utxoSnapshot(t, bc)
+
+	utxoSet.Disconnect(block)
+	if got := utxoSnapshot(t, bc); !reflect.DeepEqual(got, before) {
+		t.Errorf("disconnecting the block left %d UTXO entries, want the %d from before it", len(got), len(before))
+	}
+
+	utxoSet.Update(block)
+	if got := utxoSnapshot(t, bc); !reflect.DeepEqual(got, after) {
+		t.Errorf("connecting the block again left %d UTXO entries, want %d", len(got), len(after))
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const maxFutureBlockTime = 2 * 60 * 60
+const medianTimeSpan = 11
+
+// Consensus limits of blocks and transactions. The weight counts the signatures and public
+// keys of the inputs once and every other serialized byte four times, which favours
+// spending outputs over creating them. A block weighs at least its size, so the weight
+// also bounds how large it is. Every input is one signature check.
+const maxBlockWeight = 4 * 1000 * 1000
+const maxBlockSigOps = 20000
+const maxTransactionSize = 100 * 1000
+const maxTransactionInputs = 1000
+const maxTransactionOutputs = 1000
+
+type RejectReason int
+
+const (
+	RejectDuplicate RejectReason = iota + 1
+	RejectMalformed
+	RejectHighHash
+	RejectBadMerkleRoot
+	RejectUnknownParent
+	RejectBadHeight
+	RejectBadDifficulty
+	RejectBadTimestamp
+	RejectMissingInputs
+	RejectDoubleSpend
+	RejectImmatureSpend
+	RejectBadSignature
+	RejectBadTxValue
+	RejectBadCoinbaseValue
+	RejectBlockTooLarge
+	RejectTxTooLarge
+	RejectBadParent
+	RejectDuplicateTxID
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectMalformed:
+		return "malformed"
+	case RejectHighHash:
+		return "high-hash"
+	case RejectBadMerkleRoot:
+		return "bad-merkle-root"
+	case RejectUnknownParent:
+		return "unknown-parent"
+	case RejectBadHeight:
+		return "bad-height"
+	case RejectBadDifficulty:
+		return "bad-difficulty"
+	case RejectBadTimestamp:
+		return "bad-timestamp"
+	case RejectMissingInputs:
+		return "missing-inputs"
+	case RejectDoubleSpend:
+		return "double-spend"
+	case RejectImmatureSpend:
+		return "immature-spend"
+	case RejectBadSignature:
+		return "bad-signature"
+	case RejectBadTxValue:
+		return "bad-tx-value"
+	case RejectBadCoinbaseValue:
+		return "bad-coinbase-value"
+	case RejectBlockTooLarge:
+		return "block-too-large"
+	case RejectTxTooLarge:
+		return "tx-too-large"
+	case RejectBadParent:
+		return "bad-prevblk"
+	case RejectDuplicateTxID:
+		return "duplicate-txid"
+	default:
+		return "unknown"
+	}
+}
+
+// BlockValidationError describes why a block was refused
+type BlockValidationError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e *BlockValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+func rejectBlock(reason RejectReason, format string, a ...interface{}) *BlockValidationError {
+	return &BlockValidationError{reason, fmt.Sprintf(format, a...)}
+}
+
+// ValidateBlock runs the context-free checks and the checks against the block's parent.
+// The transactions are checked against the UTXO set when the block is connected.
+func ValidateBlock(tx *bolt.Tx, block *Block) error {
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
+
+	return checkBlockContext(tx, block)
+}
+
+// CheckBlock validates everything that does not depend on the rest of the chain
+func CheckBlock(block *Block) error {
+	if err := checkBlockStructure(block); err != nil {
+		return err
+	}
+	if err := checkMerkleRoot(block); err != nil {
+		return err
+	}
+
+	return checkProofOfWork(block)
+}
+
+func checkBlockStructure(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return rejectBlock(RejectMalformed, "block has no transactions")
+	}
+	if !block.Transactions[0].IsCoinbase() {
+		return rejectBlock(RejectMalformed, "first transaction is not a coinbase")
+	}
+	if block.Timestamp < 0 {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is negative", block.Timestamp)
+	}
+
+	if err := checkBlockLimits(block); err != nil {
+		return err
+	}
+
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return rejectBlock(RejectMalformed, "more than one coinbase")
+		}
+		if err := checkTransaction(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkBlockLimits checks the weight and signature checks of a whole block
+func checkBlockLimits(block *Block) error {
+	weight, sigOps := 4*len(block.Serialize()), 0
+	for _, tx := range block.Transactions {
+		weight -= 3 * signatureBytes(tx)
+		sigOps += transactionSigOps(tx)
+	}
+	if weight > maxBlockWeight {
+		return rejectBlock(RejectBlockTooLarge, "block weighs %d, more than %d", weight, maxBlockWeight)
+	}
+	if sigOps > maxBlockSigOps {
+		return rejectBlock(RejectBlockTooLarge, "block has %d signature checks, more than %d", sigOps, maxBlockSigOps)
+	}
+
+	return nil
+}
+
+// checkTransaction runs the checks a transaction allows without the outputs it spends, the
+// same for the mempool and for blocks: the limits, inputs and outputs to have, each outpoint
+// spent once and output values within the coin supply
+func checkTransaction(tx *Transaction) error {
+	if err := checkTransactionLimits(tx); err != nil {
+		return err
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return rejectBlock(RejectMalformed, "transaction %x has no inputs or outputs", tx.ID)
+	}
+
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return rejectBlock(RejectBadTxValue, "transaction %x has a negative output", tx.ID)
+		}
+		// the sum is checked this way so it cannot overflow
+		if out.Value > maxSupply()-total {
+			return rejectBlock(RejectBadTxValue, "transaction %x pays out more than the coin supply", tx.ID)
+		}
+		total += out.Value
+	}
+
+	if !tx.IsCoinbase() {
+		spent := make(map[Outpoint]bool)
+		for _, vin := range tx.Vin {
+			outpoint := Outpoint{vin.TxID, vin.Vout}
+			if spent[outpoint] {
+				return rejectBlock(RejectDoubleSpend, "transaction %x spends output %x:%d twice", tx.ID, vin.TxID, vin.Vout)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+func checkTransactionLimits(tx *Transaction) error {
+	if len(tx.Vin) > maxTransactionInputs {
+		return rejectBlock(RejectTxTooLarge, "transaction %x has %d inputs, more than %d", tx.ID, len(tx.Vin), maxTransactionInputs)
+	}
+	if len(tx.Vout) > maxTransactionOutputs {
+		return rejectBlock(RejectTxTooLarge, "transaction %x has %d outputs, more than %d", tx.ID, len(tx.Vout), maxTransactionOutputs)
+	}
+	if size := len(tx.Serialize()); size > maxTransactionSize {
+		return rejectBlock(RejectTxTooLarge, "transaction %x is %d bytes, more than %d", tx.ID, size, maxTransactionSize)
+	}
+
+	return nil
+}
+
+func transactionWeight(tx *Transaction) int {
+	return 4*len(tx.Serialize()) - 3*signatureBytes(tx)
+}
+
+func signatureBytes(tx *Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	size := 0
+	for _, vin := range tx.Vin {
+		size += len(vin.Signature) + len(vin.PubKey)
+	}
+
+	return size
+}
+
+func transactionSigOps(tx *Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	return len(tx.Vin)
+}
+
+// checkMerkleRoot makes sure the transactions are the ones committed to by the block hash:
+// the header must carry their Merkle root, every ID must match the transaction contents
+// and no transaction may appear twice
+func checkMerkleRoot(block *Block) error {
+	if block.MerkleRoot != block.HashTransactions() {
+		return rejectBlock(RejectBadMerkleRoot, "Merkle root %x does not match the transactions", block.MerkleRoot)
+	}
+
+	seen := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		if bytes.Compare([]byte(tx.ID), tx.Hash()) != 0 {
+			return rejectBlock(RejectBadMerkleRoot, "transaction %x does not match its ID", tx.ID)
+		}
+		if seen[tx.ID] {
+			return rejectBlock(RejectBadMerkleRoot, "duplicate transaction %x", tx.ID)
+		}
+		seen[tx.ID] = true
+	}
+
+	return nil
+}
+
+func checkProofOfWork(block *Block) error {
+	pow := NewProofOfWork(block)
+
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(powLimit) > 0 {
+		return rejectBlock(RejectBadDifficulty, "target %08x is out of range", block.Bits)
+	}
+
+	if bytes.Compare(pow.Hash(), []byte(block.Hash)) != 0 {
+		return rejectBlock(RejectHighHash, "block hash %x does not match its contents", block.Hash)
+	}
+	if !pow.Validate() {
+		return rejectBlock(RejectHighHash, "block hash %x is above the target", block.Hash)
+	}
+
+	return nil
+}
+
+// checkOrphanDifficulty refuses a block whose parent is unknown when its target is easier
+// than one retarget could make the target of the best known header. Its difficulty cannot be
+// checked against the parent, so the orphan pool would otherwise take cheaply mined blocks.
+func checkOrphanDifficulty(block *Block, best *headerNode) error {
+	limit := CompactToBig(best.Header.Bits)
+	limit.Mul(limit, big.NewInt(4))
+
+	if CompactToBig(block.Bits).Cmp(limit) > 0 {
+		return rejectBlock(RejectBadDifficulty, "target %08x is easier than a retarget from %08x allows", block.Bits, best.Header.Bits)
+	}
+
+	return nil
+}
+
+// checkBlockContext validates the block against its parent
+func checkBlockContext(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(blocksBucket))
+
+	if b.Get([]byte(block.Hash)) != nil {
+		return rejectBlock(RejectDuplicate, "block %x is already known", block.Hash)
+	}
+
+	parent := getBlock(b, []byte(block.PreviousHash))
+	if parent == nil {
+		return rejectBlock(RejectUnknownParent, "parent %x is not known", block.PreviousHash)
+	}
+	if block.Height != parent.Height+1 {
+		return rejectBlock(RejectBadHeight, "height %d does not follow parent height %d", block.Height, parent.Height)
+	}
+
+	if expected := nextBits(b, parent); block.Bits != expected {
+		return rejectBlock(RejectBadDifficulty, "bits %08x, expected %08x", block.Bits, expected)
+	}
+
+	timestamp := block.Timestamp
+	if timestamp < medianTimePast(b, parent) {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is before the median time past", timestamp)
+	}
+	if timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return rejectBlock(RejectBadTimestamp, "timestamp %d is too far in the future", timestamp)
+	}
+
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the block and its ancestors
+func medianTimePast(b *bolt.Bucket, block *Block) int64 {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeSpan && block != nil; i++ {
+		timestamps = append(timestamps, block.Timestamp)
+		block = getBlock(b, []byte(block.PreviousHash))
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// checkBlockTransactions validates the transactions against the UTXO set the block is connected to
+func checkBlockTransactions(tx *bolt.Tx, block *Block) error {
+	utxo := tx.Bucket([]byte(utxoBucket))
+	created := make(map[string]TXOutputs)
+	spent := make(map[string]bool)
+	fees := 0
+
+	// connecting a transaction would overwrite the unspent outputs of an earlier one with
+	// the same ID, and disconnecting it would not bring them back
+	for _, transaction := range block.Transactions {
+		if utxo.Get([]byte(transaction.ID)) != nil {
+			return rejectBlock(RejectDuplicateTxID, "transaction %x has the ID of a transaction with unspent outputs", transaction.ID)
+		}
+	}
+
+	for _, transaction := range block.Transactions[1:] {
+		var prevOuts []TXOutput
+		inValue := 0
+
+		for _, vin := range transaction.Vin {
+			outpoint := fmt.Sprintf("%x:%d", vin.TxID, vin.Vout)
+			if spent[outpoint] {
+				return rejectBlock(RejectDoubleSpend, "output %s is spent twice", outpoint)
+			}
+			spent[outpoint] = true
+
+			outs, ok := findUnspentOutputs(utxo, created, vin.TxID)
+			out, found := outs.Outputs[vin.Vout]
+			if !ok || !found {
+				return rejectBlock(RejectMissingInputs, "output %s is not unspent", outpoint)
+			}
+			if !outs.IsMature(block.Height) {
+				return rejectBlock(RejectImmatureSpend, "output %s is a coinbase that has not matured", outpoint)
+			}
+
+			prevOuts = append(prevOuts, out)
+			inValue += out.Value
+		}
+
+		outValue := 0
+		for _, out := range transaction.Vout {
+			outValue += out.Value
+		}
+		if outValue > inValue {
+			return rejectBlock(RejectBadTxValue, "transaction %x spends more than its inputs", transaction.ID)
+		}
+		fees += inValue - outValue
+
+		if !transaction.VerifyInputs(prevOuts) {
+			return rejectBlock(RejectBadSignature, "transaction %x has an invalid signature", transaction.ID)
+		}
+
+		outputs := NewTXOutputs()
+		outputs.Height = block.Height
+		for outIdx, out := range transaction.Vout {
+			outputs.Outputs[outIdx] = out
+		}
+		created[transaction.ID] = outputs
+	}
+
+	coinbaseValue := 0
+	for _, out := range block.Transactions[0].Vout {
+		coinbaseValue += out.Value
+	}
+	if subsidy := blockSubsidy(block.Height); coinbaseValue > subsidy+fees {
+		return rejectBlock(RejectBadCoinbaseValue, "coinbase pays %d, more than the subsidy of %d plus %d in fees", coinbaseValue, subsidy, fees)
+	}
+
+	return nil
+}
+
+func findUnspentOutputs(utxo *bolt.Bucket, created map[string]TXOutputs, txID string) (TXOutputs, bool) {
+	if outs, ok := created[txID]; ok {
+		return outs, true
+	}
+
+	outsBytes := utxo.Get([]byte(txID))
+	if outsBytes == nil {
+		return TXOutputs{}, false
+	}
+
+	return DeserializeOutputs(outsBytes), true
+}
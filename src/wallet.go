@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/crypto/ripemd160"
 	"io/ioutil"
@@ -15,7 +16,7 @@ import (
 )
 
 const version = byte(0x00)
-const walletFile = "wallet.dat"
+const walletFile = "wallet_%s.dat"
 const addressChecksumLen = 4
 
 type Wallet struct {
@@ -25,6 +26,9 @@ type Wallet struct {
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// Sent holds the serialized unconfirmed transactions sent from the wallet by hex ID,
+	// kept so that bumpfee can replace them
+	Sent map[string][]byte
 }
 
 func NewWallet() *Wallet {
@@ -37,6 +41,7 @@ func NewWallet() *Wallet {
 func NewWallets(nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Sent = make(map[string][]byte)
 
 	err := wallets.LoadFromFile(nodeID)
 
@@ -49,7 +54,9 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panic("ERROR: Failed to generate private key: ", err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubKey := make([]byte, pubKeyLength)
+	private.PublicKey.X.FillBytes(pubKey[:coordinateLength])
+	private.PublicKey.Y.FillBytes(pubKey[coordinateLength:])
 
 	return *private, pubKey
 }
@@ -115,6 +122,53 @@ func (ws *Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// FindWallet returns the address and wallet owning the public key
+func (ws *Wallets) FindWallet(pubKey []byte) (string, *Wallet, bool) {
+	for address, wallet := range ws.Wallets {
+		if bytes.Equal(wallet.PublicKey, pubKey) {
+			return address, wallet, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// RecordTransaction keeps a sent transaction until it is replaced
+func (ws *Wallets) RecordTransaction(tx *Transaction) {
+	ws.Sent[hex.EncodeToString([]byte(tx.ID))] = tx.Serialize()
+}
+
+func (ws *Wallets) ForgetTransaction(txID string) {
+	delete(ws.Sent, txID)
+}
+
+func (ws *Wallets) GetTransaction(txID string) (*Transaction, bool) {
+	data, ok := ws.Sent[txID]
+	if !ok {
+		return nil, false
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &tx, true
+}
+
+// PendingSpends returns the outputs spent by the unconfirmed transactions sent from the
+// wallet. Spending them again would replace those transactions.
+func (ws *Wallets) PendingSpends() map[Outpoint]bool {
+	spent := make(map[Outpoint]bool)
+	for txID := range ws.Sent {
+		tx, _ := ws.GetTransaction(txID)
+		for _, vin := range tx.Vin {
+			spent[Outpoint{vin.TxID, vin.Vout}] = true
+		}
+	}
+
+	return spent
+}
+
 func (ws *Wallets) LoadFromFile(nodeID string) error {
 	walletFile := fmt.Sprintf(walletFile, nodeID)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
@@ -135,6 +189,9 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	}
 
 	ws.Wallets = wallets.Wallets
+	if wallets.Sent != nil {
+		ws.Sent = wallets.Sent
+	}
 
 	return nil
 }